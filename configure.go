@@ -9,14 +9,27 @@ package configure
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/jessevdk/go-flags"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
 	"io"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -35,42 +48,395 @@ type Options struct {
 	ManDir      string `long:"mandir" description:"man documentation"`
 }
 
-// NewOptions creates a new Options with common default values.
+// NewOptions creates a new Options with common default values. All
+// directories are derived from Prefix (directly or through ExecPrefix and
+// DataRootDir), so setting only --prefix relocates every other directory.
+// The references use the ExpandOpen and ExpandClose delimiters.
 func NewOptions() *Options {
 	return &Options{
 		Prefix:      "/usr/local",
-		ExecPrefix:  "${prefix}",
-		BinDir:      "${execprefix}/bin",
-		LibExecDir:  "${execprefix}/libexec",
-		LibDir:      "${execprefix}/lib",
-		SysConfDir:  "${prefix}/etc",
-		DataRootDir: "${prefix}/share",
-		DataDir:     "${datarootdir}",
-		ManDir:      "${datarootdir}/man",
+		ExecPrefix:  reference("prefix"),
+		BinDir:      reference("execprefix") + "/bin",
+		LibExecDir:  reference("execprefix") + "/libexec",
+		LibDir:      reference("execprefix") + "/lib",
+		SysConfDir:  reference("prefix") + "/etc",
+		DataRootDir: reference("prefix") + "/share",
+		DataDir:     reference("datarootdir"),
+		ManDir:      reference("datarootdir") + "/man",
 	}
 }
 
-// Package is the package name in which the GoConfig file will be written
+// reference returns a reference to the variable with the given name.
+func reference(name string) string {
+	return ExpandOpen + name + ExpandClose
+}
+
+// EmptyValue specifies how string options which are explicitly set to an
+// empty value, while having a non-empty default, are handled.
+type EmptyValue int
+
+const (
+	// EmptyValueDefault uses the default value of the option instead.
+	EmptyValueDefault EmptyValue = iota
+
+	// EmptyValueKeep keeps the empty value.
+	EmptyValueKeep
+
+	// EmptyValueError makes Configure return an error.
+	EmptyValueError
+)
+
+// EmptyValues specifies how empty option values are handled (see EmptyValue).
+var EmptyValues = EmptyValueDefault
+
+// Strict enables strict checking of the command line arguments. In strict
+// mode, Configure returns an error if positional arguments are given, or if
+// the go configuration does not compile (see Config.ValidateGoConfig).
+var Strict = false
+
+// Quiet disables printing errors while parsing the command line, including
+// the help message for --help. The caller is then responsible for reporting
+// the error returned by Configure.
+var Quiet = false
+
+// WrapperOnly disables generating all files except for the wrapper Makefile
+// including the Makefile file. Use this when maintaining the Makefile file
+// manually.
+var WrapperOnly = false
+
+// DefaultsFile is the filename of a file containing default option values,
+// similar to the config.site file of gnu configure. If the file exists, its
+// values override the built-in defaults, but not the values specified on the
+// command line. The file is read as JSON if it has a .json extension, mapping
+// long option names to values. Otherwise it is read as an INI style file
+// containing name = value lines.
+var DefaultsFile = ""
+
+// OutputDir is the directory in which all generated files are written. The
+// directory is created if it does not exist yet.
+var OutputDir = "."
+
+// Stdout can be used as the filename of any of the generated files to write
+// it to standard output instead, for example to pipe it into another tool.
+// Since the outputs would be concatenated, it is recommended to write at most
+// one file to standard output and disable the others.
+const Stdout = "-"
+
+// Package is the package name in which the GoConfig file will be written. If
+// empty, no package clause is written and the GoConfig file is not a valid go
+// file on its own. Use GoConfigFragment to generate a snippet for inclusion
+// in other go source instead.
 var Package = "main"
 
+// GoConfigPackages maps additional go configuration filenames (relative to
+// OutputDir) to package names. A go configuration with the corresponding
+// package clause is written to each file, next to the GoConfig file. This can
+// be used to provide the same configuration to several packages, for example
+// to both the main package (through GoConfig and Package) and an internal
+// config package:
+//
+//	GoConfigPackages = map[string]string{
+//		"internal/config/appconfig.go": "config",
+//	}
+var GoConfigPackages map[string]string
+
+// GoConfigBuildTags is a list of build tags which are all required for the
+// GoConfig file to be compiled. If not empty, the corresponding //go:build
+// and // +build constraint lines are written before the package clause.
+var GoConfigBuildTags []string
+
 // Makefile is the filename of the makefile that will be generated
 var Makefile = "go.make"
 
+// MakefileConditional enables writing the option variables in the Makefile
+// using conditional assignment (name ?= value), so that they can be
+// overridden from the environment without reconfiguring, for example
+// prefix=/opt make install. If disabled, the variables are written using
+// plain assignment (name = value) and can only be overridden on the make
+// command line.
+var MakefileConditional = true
+
+// WrapperMakefile is the filename of the wrapper makefile including the
+// Makefile file, created in the same directory as the Makefile (unless it
+// already exists). If left empty, no wrapper is created.
+var WrapperMakefile = "Makefile"
+
+// WriteGitignore enables adding the files generated by Configure to the
+// .gitignore file in OutputDir, which is created if needed. Files which are
+// already listed are not added again. A WrapperMakefile which already existed
+// with different contents is not considered generated.
+var WriteGitignore = false
+
+// MakefilePrologue is written verbatim at the start of the Makefile (after
+// the shebang line).
+var MakefilePrologue = ""
+
+// MakefileEpilogue is written verbatim at the end of the Makefile.
+var MakefileEpilogue = ""
+
+// ExtraRules is written verbatim after the standard rules of the Makefile,
+// and can be used to add custom rules.
+var ExtraRules = ""
+
+// ExtraPhony lists additional phony targets (for example those defined in
+// ExtraRules), which are added to the .PHONY rule of the Makefile.
+var ExtraPhony []string
+
+// CMakeFile is the filename of the cmake file that will be generated,
+// containing all the variable values as cache entries. If left empty, no
+// cmake file is generated.
+var CMakeFile = ""
+
+// RPMSpec is the filename of the rpm spec file skeleton that will be
+// generated. If left empty, no spec file is generated.
+var RPMSpec = ""
+
+// NinjaFile is the filename of the ninja build file that will be generated.
+// If left empty, no ninja build file is generated.
+var NinjaFile = ""
+
+// ShellFile is the filename of the shell script that will be generated,
+// exporting all the variable values (see Config.WriteShell). If left empty,
+// no shell script is generated.
+var ShellFile = ""
+
+// MarkdownConfig is the filename of the markdown file that will be generated,
+// documenting all the options (see Config.WriteMarkdownConfig). If left empty,
+// no markdown file is generated.
+var MarkdownConfig = ""
+
 // GoConfig is the filename of the go file that will be generated containing
 // all the variable values.
 var GoConfig = "appconfig"
 
+// GoConfigSuffix is the suffix added to the GoConfig filename if it does not
+// have it yet. If empty, the GoConfig file is written to exactly GoConfig
+// (and GoConfigTest has no effect on the filename).
+var GoConfigSuffix = ".go"
+
+// GoConfigTest makes the GoConfig file only available to tests, by writing it
+// to a _test.go file (e.g. appconfig_test.go).
+var GoConfigTest = false
+
+// GoConfigFragment only writes the struct fields of the go configuration to
+// the GoConfig file, without package clause, variable declaration or values.
+// The result can be used to embed the configuration fields in another struct
+// (for example using text/template).
+var GoConfigFragment = false
+
+// GoConfigOmitEmpty omits options which resolved to an empty value (an empty
+// string, slice or map) from the go configuration. If not set, such options
+// are annotated with a comment instead.
+var GoConfigOmitEmpty = false
+
+// GoConfigExpand enables expanding variable references in the values of the
+// go configuration. If disabled, values are written as specified, for example
+// ${prefix}/bin, and the GoConfig file additionally contains a
+// GoConfigVariable + "Expand" function expanding such references at runtime
+// using the values of the go configuration.
+var GoConfigExpand = true
+
+// GoConfigConversions maps the value of a configure struct tag on a string
+// option to a function converting the expanded value of the option. The
+// converted value, and its type, are written to the go configuration instead
+// of the string. For example, a port option tagged with `configure:"int"` can
+// be specified as ${defaultport} on the command line, but is written as an int.
+// Conversions are only applied if GoConfigExpand is enabled, since unexpanded
+// values can generally not be converted. Other options are written with their
+// own type. Additional conversions may be added to the map.
+var GoConfigConversions = map[string]func(string) (interface{}, error){
+	"int": func(s string) (interface{}, error) {
+		return strconv.Atoi(s)
+	},
+
+	"int64": func(s string) (interface{}, error) {
+		return strconv.ParseInt(s, 0, 64)
+	},
+
+	"uint": func(s string) (interface{}, error) {
+		v, err := strconv.ParseUint(s, 0, 0)
+		return uint(v), err
+	},
+
+	"float64": func(s string) (interface{}, error) {
+		return strconv.ParseFloat(s, 64)
+	},
+
+	"bool": func(s string) (interface{}, error) {
+		return strconv.ParseBool(s)
+	},
+}
+
+// GoConfigSources annotates each option in the go configuration with the
+// source of its value (see Config.Source).
+var GoConfigSources = false
+
 // GoConfigVariable is the name of the variable inside the GoConfig file
 // containing all the variable values.
 var GoConfigVariable = "AppConfig"
 
-// Target is the executable name to build. If left empty, the name is deduced
-// from the directory (similar to what go does)
+// Target is the executable name to build. If left empty, the name is taken
+// from the CONFIGURE_TARGET environment variable, or otherwise deduced from
+// the directory (similar to what go does)
 var Target = ""
 
+// BuildPackage is the package built by the Makefile, for example ./cmd/app.
+// If left empty, the package in the current directory is built.
+var BuildPackage = ""
+
+// DockerTarget enables a docker rule in the Makefile, building a docker image
+// tagged with the target name and version from DOCKERFILE. All configured
+// variables are passed to docker as build arguments. The rule fails with a
+// descriptive error if docker cannot be found (or DOCKER is not set).
+var DockerTarget = false
+
 // Version is the application version
 var Version []int = []int{0, 1}
 
+// GoConfigBuildInfo enables reading the application version from the build
+// information embedded in the binary at runtime. If set, the GoConfig file
+// additionally contains a GoConfigVariable + "Version" function returning the
+// main module version, falling back to Version when the binary was built
+// without module version information. The generated Makefile and ninja file
+// use the default go build flags, so for source builds the fallback is used
+// unless the go command derives a version from version control (which Go 1.24
+// and later do for tagged commits).
+var GoConfigBuildInfo = false
+
+// BuildID is an identifier of the build, available as the buildid variable
+// and written to the Makefile and the go configuration. If left empty, a
+// build ID is generated from the application version, the current git commit
+// (if any) and the configured values. The generated build ID is stable, so
+// that reconfiguring with the same options does not change the outputs.
+var BuildID = ""
+
+// VersionFromGit returns the version of the most recent tag reachable from
+// the current commit, as reported by git describe --tags in the current
+// directory. The tag must be of the form vMAJOR.MINOR.PATCH (the leading v and
+// the MINOR and PATCH components are optional). An error is returned if git is
+// not available, no tag can be found (for example in a shallow clone) or the
+// tag is not a version. The result can be assigned to Version.
+func VersionFromGit() ([]int, error) {
+	out, err := exec.Command("git", "describe", "--tags").Output()
+
+	if err != nil {
+		return nil, fmt.Errorf("could not describe git version: %s", err)
+	}
+
+	return parseGitVersion(strings.TrimSpace(string(out)))
+}
+
+func parseGitVersion(s string) ([]int, error) {
+	r := regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:$|[-+])`)
+	match := r.FindStringSubmatch(s)
+
+	if match == nil {
+		return nil, fmt.Errorf("invalid git version %s", s)
+	}
+
+	var ret []int
+
+	for _, m := range match[1:] {
+		if len(m) == 0 {
+			break
+		}
+
+		v, _ := strconv.Atoi(m)
+		ret = append(ret, v)
+	}
+
+	return ret, nil
+}
+
+// VersionSuffix is appended to the dotted application version, for example to
+// specify a pre-release or build metadata (such as "-rc1+build5"). The suffix
+// given to the --version-suffix option of configure is appended after
+// VersionSuffix, without modifying it. Version itself is not affected, and
+// neither is the version returned by VersionFromGit, which only contains the
+// numeric components of the tag. To retain a git derived suffix, assign it to
+// VersionSuffix or pass it to --version-suffix.
+var VersionSuffix = ""
+
+// VersionSeparator is the separator between the version components in the
+// version string.
+var VersionSeparator = "."
+
+// VersionPadding is the minimum number of digits of each version component in
+// the version string. Components are padded with leading zeros.
+var VersionPadding = 0
+
+func versionString() string {
+	parts := make([]string, len(Version))
+
+	for i, v := range Version {
+		parts[i] = fmt.Sprintf("%0*d", VersionPadding, v)
+	}
+
+	return strings.Join(parts, VersionSeparator) + VersionSuffix
+}
+
+// versionString returns the version string including the suffix given to the
+// --version-suffix option.
+func (x *Config) versionString() string {
+	return versionString() + x.versionSuffix
+}
+
+// OptionTransform, if not nil, is called for each string option with its long
+// name and expanded value, and returns the value to use instead. This can be
+// used to normalize values before they are written to the generated files.
+// Options referencing a transformed option see its transformed value.
+var OptionTransform func(longname, value string) string
+
+// Expander expands variable references in option values.
+type Expander interface {
+	// Expand expands all variable references in value. The variables map
+	// contains the unexpanded values of all string options, keyed by their
+	// long name as well as their field name. Expand returns the expanded
+	// value and the names of all variables the value depends on.
+	Expand(value string, variables map[string]string) (string, []string)
+}
+
+// ValueExpander, if not nil, is the Expander used to expand option values.
+// If nil, the built-in expansion replaces ${name} references (see ExpandOpen
+// and ExpandClose) with the (recursively expanded) value of the option with
+// the long name (or field name) name. Only values expanded by the built-in
+// expansion are written to the Makefile as variable references, values
+// expanded by a custom expander are written as their expanded value.
+var ValueExpander Expander
+
+// ExpandOpen and ExpandClose are the delimiters of variable references in
+// option values, for example @{ and } to reference variables as @{prefix}.
+// They apply to the built-in expansion and the GoConfigVariable + "Expand"
+// function, but not to the generated Makefile, which always uses $(name).
+var (
+	ExpandOpen  = "${"
+	ExpandClose = "}"
+)
+
+// variableRegexp matches variable references using the delimiters in
+// variableDelimiters. Variable names start with a letter or underscore,
+// followed by letters, digits, underscores or dashes. Anything else (for
+// example ${}) is not a reference and is kept literally. A reference preceded
+// by a $ (for example $${prefix}) is matched including the $, but is also
+// kept literally, like in make.
+var (
+	variableRegexp     *regexp.Regexp
+	variableDelimiters [2]string
+)
+
+// variableMatcher returns the regexp matching variable references, which is
+// only compiled again when the delimiters have changed.
+func variableMatcher() *regexp.Regexp {
+	delimiters := [2]string{ExpandOpen, ExpandClose}
+
+	if variableRegexp == nil || variableDelimiters != delimiters {
+		variableRegexp = regexp.MustCompile(`(\$?)` + regexp.QuoteMeta(ExpandOpen) + `[A-Za-z_][A-Za-z0-9_-]*` + regexp.QuoteMeta(ExpandClose))
+		variableDelimiters = delimiters
+	}
+
+	return variableRegexp
+}
+
 type expandStringPart struct {
 	Value      string
 	IsVariable bool
@@ -102,12 +468,12 @@ type expandString struct {
 	dependencies []string
 	value        string
 	hasExpanded  bool
-}
 
-func (x *expandString) dependsOn(name string) bool {
-	i := sort.SearchStrings(x.dependencies, name)
+	// clean, if true, cleans the expanded value as a path (see cleanPath)
+	clean bool
 
-	return i < len(x.dependencies) && x.dependencies[i] == name
+	// transform, if not nil, is applied to the expanded value
+	transform func(string) string
 }
 
 func (x *expandString) expand(m map[string]*expandString) string {
@@ -125,19 +491,74 @@ func (x *expandString) expand(m map[string]*expandString) string {
 
 		sort.Strings(x.dependencies)
 		x.value = buf.String()
+
+		if x.clean {
+			x.value = cleanPath(x.value)
+		}
+
+		if x.transform != nil {
+			x.applyTransform()
+		}
 	}
 
 	return x.value
 }
 
+// applyTransform replaces the value by its transformed value. Transformed
+// values are written literally, instead of in terms of the variables they
+// reference.
+func (x *expandString) applyTransform() {
+	if v := x.transform(x.value); v != x.value {
+		x.value = v
+		x.Parts = []expandStringPart{{Value: v, IsVariable: false}}
+	}
+}
+
+// cleanPath removes duplicate and trailing slashes from absolute paths. A
+// leading double slash is preserved. Other values are returned unchanged.
+func cleanPath(s string) string {
+	if !strings.HasPrefix(s, "/") {
+		return s
+	}
+
+	var root string
+
+	if strings.HasPrefix(s, "//") && !strings.HasPrefix(s, "///") {
+		root = "/"
+	}
+
+	var buf bytes.Buffer
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '/' || i == 0 || s[i-1] != '/' {
+			buf.WriteByte(s[i])
+		}
+	}
+
+	ret := buf.String()
+
+	if len(ret) > 1 {
+		ret = strings.TrimSuffix(ret, "/")
+	}
+
+	return root + ret
+}
+
 // Config represents the current configuration. See Configure for more
 // information.
 type Config struct {
 	*flags.Parser
 
-	values    []*flags.Option
-	valuesMap map[string]*flags.Option
-	expanded  map[string]*expandString
+	values        []*flags.Option
+	valuesMap     map[string]*flags.Option
+	defaults      map[string]string
+	loaded        map[string]bool
+	save          bool
+	buildID       string
+	versionSuffix string
+	target        string
+	expanded      map[string]*expandString
+	builtin       *flags.Group
 }
 
 func eachGroup(g *flags.Group, f func(g *flags.Group)) {
@@ -148,14 +569,35 @@ func eachGroup(g *flags.Group, f func(g *flags.Group)) {
 	}
 }
 
+// optionName returns the variable name of option. This is the long name of
+// the option, or the name of its struct field for options which only have a
+// short name.
+func optionName(option *flags.Option) string {
+	if len(option.LongName) == 0 && option.ShortName != 0 {
+		return option.Field().Name
+	}
+
+	return option.LongName
+}
+
 func (x *Config) extract() ([]*flags.Option, map[string]*flags.Option) {
 	valuesmap := make(map[string]*flags.Option)
 	var values []*flags.Option
 
 	eachGroup(x.Parser.Command.Group, func(g *flags.Group) {
+		// Options of configure itself are not configured values
+		if g == x.builtin {
+			return
+		}
+
 		for _, option := range g.Options() {
-			if len(option.LongName) > 0 {
-				valuesmap[option.LongName] = option
+			// Callbacks do not have a value to configure
+			if reflect.ValueOf(option.Value()).Kind() == reflect.Func {
+				continue
+			}
+
+			if name := optionName(option); len(name) > 0 {
+				valuesmap[name] = option
 				values = append(values, option)
 			}
 		}
@@ -164,320 +606,2660 @@ func (x *Config) extract() ([]*flags.Option, map[string]*flags.Option) {
 	return values, valuesmap
 }
 
-func (x *Config) expand() map[string]*expandString {
-	ret := make(map[string]*expandString)
-
-	r, _ := regexp.Compile(`\$\{[^}]*\}`)
-
-	for name, opt := range x.valuesMap {
-		es := expandString{
-			Name: name,
-		}
-
-		// Find all variable references
-		s, ok := opt.Value().(string)
+// checkDuplicates returns an error if options in different groups have the
+// same name, since only one of them would be configured.
+func (x *Config) checkDuplicates() error {
+	groups := make(map[string]*flags.Group)
+	var err error
 
-		if !ok {
-			continue
+	eachGroup(x.Parser.Command.Group, func(g *flags.Group) {
+		if g == x.builtin || err != nil {
+			return
 		}
 
-		matches := r.FindAllStringIndex(s, -1)
-
-		for i, match := range matches {
-			var prefix string
+		for _, option := range g.Options() {
+			name := optionName(option)
 
-			if i == 0 {
-				prefix = s[0:match[0]]
-			} else {
-				prefix = s[matches[i-1][1]:match[0]]
+			if len(name) == 0 || reflect.ValueOf(option.Value()).Kind() == reflect.Func {
+				continue
 			}
 
-			if len(prefix) != 0 {
-				es.Parts = append(es.Parts, expandStringPart{Value: prefix, IsVariable: false})
+			if other, ok := groups[name]; ok {
+				err = fmt.Errorf("option %s is defined in both group %q and group %q", flagNames(option), other.ShortDescription, g.ShortDescription)
+				return
 			}
 
-			varname := s[match[0]+2 : match[1]-1]
-			es.Parts = append(es.Parts, expandStringPart{Value: varname, IsVariable: true})
+			groups[name] = g
 		}
+	})
 
-		if len(matches) == 0 {
-			es.Parts = append(es.Parts, expandStringPart{Value: s, IsVariable: false})
-		} else {
-			last := matches[len(matches)-1]
-			suffix := s[last[1]:]
+	return err
+}
 
-			if len(suffix) != 0 {
-				es.Parts = append(es.Parts, expandStringPart{Value: suffix, IsVariable: false})
-			}
+func newExpandString(name string, s string) *expandString {
+	es := expandString{
+		Name: name,
+	}
+
+	// Find all variable references, skipping escaped ones
+	last := 0
+
+	for _, match := range variableMatcher().FindAllStringSubmatchIndex(s, -1) {
+		if match[3] != match[2] {
+			continue
+		}
+
+		if prefix := s[last:match[0]]; len(prefix) != 0 {
+			es.Parts = append(es.Parts, expandStringPart{Value: prefix, IsVariable: false})
 		}
 
-		ret[name] = &es
+		varname := s[match[0]+len(ExpandOpen) : match[1]-len(ExpandClose)]
+		es.Parts = append(es.Parts, expandStringPart{Value: varname, IsVariable: true})
+
+		last = match[1]
 	}
 
-	for _, val := range ret {
-		val.expand(ret)
+	if suffix := s[last:]; len(suffix) != 0 || len(es.Parts) == 0 {
+		es.Parts = append(es.Parts, expandStringPart{Value: suffix, IsVariable: false})
 	}
 
-	return ret
+	return &es
 }
 
-// Configure runs the configure process with options as provided by the given
-// data variable. If data is nil, the default options will be used
-// (see NewOptions). Note that the data provided is simply passed to go-flags.
-// For more information on flags parsing, see the documentation of go-flags.
-// If GoConfig is not empty, then the go configuration will be written to the
-// GoConfig file. Similarly, if Makefile is not empty, the Makefile will be
-// written.
-func Configure(data interface{}) (*Config, error) {
-	if data == nil {
-		data = NewOptions()
+// resolveAliases replaces variable references by alias with references to
+// the corresponding variable.
+func (x *expandString) resolveAliases(aliases map[string]string) {
+	for i, part := range x.Parts {
+		if name, ok := aliases[part.Value]; ok && part.IsVariable {
+			x.Parts[i].Value = name
+		}
 	}
+}
 
-	parser := flags.NewParser(data, flags.PrintErrors|flags.IgnoreUnknown)
-
-	if _, err := parser.Parse(); err != nil {
-		return nil, err
+func newExpandedString(name string, value string, dependencies []string) *expandString {
+	deps := make([]string, len(dependencies))
+	copy(deps, dependencies)
+	sort.Strings(deps)
+
+	return &expandString{
+		Name:         name,
+		Parts:        []expandStringPart{{Value: value, IsVariable: false}},
+		dependencies: deps,
+		value:        value,
+		hasExpanded:  true,
 	}
+}
 
-	ret := &Config{
-		Parser: parser,
+func goConfigFilename() string {
+	if len(GoConfigSuffix) == 0 || GoConfig == Stdout {
+		return GoConfig
 	}
 
-	ret.values, ret.valuesMap = ret.extract()
-	ret.expanded = ret.expand()
+	filename := strings.TrimSuffix(GoConfig, GoConfigSuffix)
 
-	if len(GoConfig) != 0 {
-		filename := GoConfig
+	if GoConfigTest && !strings.HasSuffix(filename, "_test") {
+		filename += "_test"
+	}
 
-		if !strings.HasSuffix(filename, ".go") {
-			filename += ".go"
-		}
+	return filename + GoConfigSuffix
+}
 
-		f, err := os.Create(filename)
+// rawValues returns the unexpanded values of all string options. The
+// goconfig and makefile pseudo variables are set to the GoConfig and Makefile
+// filenames and the buildid pseudo variable to the build ID, unless an option
+// with the same name exists.
+func (x *Config) rawValues() map[string]string {
+	ret := make(map[string]string)
 
-		if err != nil {
-			return nil, err
-		}
+	ret["buildid"] = x.buildID
 
-		ret.WriteGoConfig(f)
-		f.Close()
+	if len(GoConfig) != 0 {
+		ret["goconfig"] = goConfigFilename()
 	}
 
 	if len(Makefile) != 0 {
-		f, err := os.Create(Makefile)
+		ret["makefile"] = Makefile
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	for name, opt := range x.valuesMap {
+		if s, ok := opt.Value().(string); ok {
+			if len(s) == 0 && EmptyValues == EmptyValueDefault {
+				s = x.defaults[name]
+			}
 
-		ret.WriteMakefile(f)
-		f.Close()
+			ret[name] = s
+		}
+	}
 
-		os.Chmod(Makefile, 0755)
+	return ret
+}
 
-		f, err = os.OpenFile(path.Join(path.Dir(Makefile), "Makefile"),
-			os.O_CREATE|os.O_EXCL|os.O_WRONLY,
-			0644)
+// cleanValues returns the unexpanded values of all string options, like
+// rawValues, with the paths of the standard directory options cleaned (see
+// cleanPath). Other values are kept as is.
+func (x *Config) cleanValues() map[string]string {
+	ret := x.rawValues()
 
-		if err == nil {
-			fmt.Fprintf(f, "include %s\n", path.Base(Makefile))
-			f.Close()
+	for name := range standardOptionNames() {
+		if s, ok := ret[name]; ok {
+			ret[name] = cleanPath(s)
 		}
 	}
 
-	return ret, nil
+	return ret
 }
 
-// Expand expands the variable value indicated by name
-func (x *Config) Expand(name string) string {
-	return x.expanded[name].expand(x.expanded)
-}
+// aliases maps the field names of options (both the name of the struct field
+// and the name of the go config field) to their long names, so that variables
+// can also be referenced by field name (e.g. ${Prefix}).
+func (x *Config) aliases(variables map[string]string) map[string]string {
+	ret := make(map[string]string)
 
-// WriteGoConfig writes the go configuration file containing all the variable
-// values to the given writer. Note that it will write a package line if
-// the Package variable is not empty. The GoConfigVariable name will
-// be used as the variable name for the configuration.
-func (x *Config) WriteGoConfig(writer io.Writer) {
-	if len(Package) > 0 {
-		fmt.Fprintf(writer, "package %v\n\n", Package)
+	for name, opt := range x.valuesMap {
+		for _, alias := range []string{opt.Field().Name, goFieldName(name)} {
+			if _, ok := variables[alias]; !ok && len(alias) != 0 && alias != name {
+				ret[alias] = name
+			}
+		}
 	}
 
-	fmt.Fprintf(writer, "var %s = struct {\n", GoConfigVariable)
-	values := make([]string, 0)
+	return ret
+}
 
-	variables := make([]string, len(x.values))
+// withAliases returns a copy of variables additionally containing the values
+// of all aliases.
+func withAliases(variables map[string]string, aliases map[string]string) map[string]string {
+	ret := make(map[string]string, len(variables)+len(aliases))
 
-	// Write all options
-	for i, opt := range x.values {
-		variables[i] = opt.LongName
+	for name, s := range variables {
+		ret[name] = s
 	}
 
-	sort.Strings(variables)
-
-	for i, name := range variables {
-		if i != 0 {
-			io.WriteString(writer, "\n")
+	for alias, name := range aliases {
+		if s, ok := variables[name]; ok {
+			ret[alias] = s
 		}
+	}
 
-		option := x.valuesMap[name]
-		val := option.Value()
-
-		fmt.Fprintf(writer, "\t// %s\n", option.Description)
-		fmt.Fprintf(writer, "\t%v %T\n", strings.Title(name), val)
+	return ret
+}
 
-		var value string
+func (x *Config) expand() map[string]*expandString {
+	ret := make(map[string]*expandString)
 
-		if _, ok := x.expanded[option.LongName]; ok {
-			value = fmt.Sprintf("%#v", x.Expand(option.LongName))
+	variables := x.cleanValues()
+	aliases := x.aliases(variables)
+	dirs := standardOptionNames()
+	for name, s := range variables {
+		if ValueExpander == nil {
+			ret[name] = newExpandString(name, s)
+			ret[name].resolveAliases(aliases)
+			ret[name].clean = dirs[name]
 		} else {
-			value = fmt.Sprintf("%#v", val)
+			value, deps := ValueExpander.Expand(s, withAliases(variables, aliases))
+
+			if dirs[name] {
+				value = cleanPath(value)
+			}
+
+			for i, dep := range deps {
+				if name, ok := aliases[dep]; ok {
+					deps[i] = name
+				}
+			}
+
+			ret[name] = newExpandedString(name, value, deps)
 		}
 
-		values = append(values, value)
-	}
+		if _, ok := x.valuesMap[name]; ok && OptionTransform != nil {
+			name := name
+			ret[name].transform = func(s string) string { return OptionTransform(name, s) }
 
-	if len(variables) > 0 {
-		io.WriteString(writer, "\n")
+			// Values of custom expanders are already expanded
+			if ret[name].hasExpanded {
+				ret[name].applyTransform()
+			}
+		}
 	}
 
-	io.WriteString(writer, "\t// Application version\n")
-	io.WriteString(writer, "\tVersion []int\n")
-	fmt.Fprintln(writer, "}{")
+	names := make([]string, 0, len(ret))
 
-	for _, v := range values {
-		fmt.Fprintf(writer, "\t%v,\n", v)
+	for name := range ret {
+		names = append(names, name)
 	}
 
-	for i, v := range Version {
-		if i != 0 {
-			io.WriteString(writer, ", ")
-		} else {
-			io.WriteString(writer, "\t[]int{")
-		}
+	// Expand in a fixed order so that the result does not depend on map
+	// iteration order (which matters for circular references)
+	sort.Strings(names)
 
-		fmt.Fprintf(writer, "%v", v)
+	for _, name := range names {
+		ret[name].expand(ret)
 	}
 
-	fmt.Fprintln(writer, "},")
-	fmt.Fprintln(writer, "}")
+	return ret
 }
 
-// WriteMakefile writes a Makefile for the given parser to the given writer.
-// The Makefile contains the common build, clean, distclean, install and
-// uninstall rules.
-func (x *Config) WriteMakefile(writer io.Writer) {
-	// Write a very basic makefile
-	io.WriteString(writer, "#!/usr/bin/make -f\n\n")
+// convertValue converts the expanded value of the given option for the go
+// configuration, according to its configure struct tag. It returns false if
+// the option has no conversion.
+func (x *Config) convertValue(name string) (interface{}, bool, error) {
+	option := x.valuesMap[name]
+	conversion := option.Field().Tag.Get("configure")
 
-	vars := make([]*expandString, 0, len(x.expanded))
+	if len(conversion) == 0 || !GoConfigExpand {
+		return nil, false, nil
+	}
+
+	if _, ok := x.expanded[name]; !ok {
+		return nil, false, fmt.Errorf("option %s has conversion %s, but is not a string", flagNames(option), conversion)
+	}
 
-	for name, v := range x.expanded {
-		inserted := false
+	convert, ok := GoConfigConversions[conversion]
 
-		// Insert into vars based on dependencies
-		for i, vv := range vars {
-			if vv.dependsOn(name) {
-				tail := make([]*expandString, len(vars)-i)
-				copy(tail, vars[i:])
+	if !ok {
+		return nil, false, fmt.Errorf("unknown conversion %s of option %s", conversion, flagNames(option))
+	}
 
-				if i == 0 {
-					vars = append([]*expandString{v}, vars...)
-				} else {
-					vars = append(append(vars[0:i], v), tail...)
-				}
+	ret, err := convert(x.Expand(name))
 
-				inserted = true
-				break
-			}
-		}
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid value %s of option %s: %s", x.Expand(name), flagNames(option), err)
+	}
 
-		if !inserted {
-			vars = append(vars, v)
+	return ret, true, nil
+}
+
+// expandValue expands variable references in strings contained in the
+// given value. Elements of slices and arrays, and keys and values of maps are
+// expanded recursively.
+func (x *Config) expandValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.String:
+		var s string
+
+		variables := x.cleanValues()
+		aliases := x.aliases(variables)
+
+		if ValueExpander == nil {
+			es := newExpandString("", v.String())
+			es.resolveAliases(aliases)
+			s = es.expand(x.expanded)
+		} else {
+			s, _ = ValueExpander.Expand(v.String(), withAliases(variables, aliases))
 		}
-	}
 
-	io.WriteString(writer, "# Variables\n")
+		return reflect.ValueOf(s).Convert(v.Type())
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
 
-	for _, v := range vars {
-		fmt.Fprintf(writer, "%s ?= ", v.Name)
+		ret := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
 
-		for _, part := range v.Parts {
-			if part.IsVariable {
-				fmt.Fprintf(writer, "$(%s)", part.Value)
-			} else {
-				fmt.Fprintf(writer, "%s", part.Value)
-			}
+		for i := 0; i < v.Len(); i++ {
+			ret.Index(i).Set(x.expandValue(v.Index(i)))
 		}
 
-		io.WriteString(writer, "\n")
-	}
+		return ret
+	case reflect.Array:
+		ret := reflect.New(v.Type()).Elem()
 
-	io.WriteString(writer, "version ?= ")
+		for i := 0; i < v.Len(); i++ {
+			ret.Index(i).Set(x.expandValue(v.Index(i)))
+		}
 
-	for i, v := range Version {
-		if i != 0 {
-			io.WriteString(writer, ".")
+		return ret
+	case reflect.Map:
+		if v.IsNil() {
+			return v
 		}
 
-		fmt.Fprintf(writer, "%v", v)
-	}
+		ret := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
 
-	io.WriteString(writer, "\n")
-	fmt.Fprintf(writer, "major_version = %v\n", Version[0])
+		for iter.Next() {
+			ret.SetMapIndex(x.expandValue(iter.Key()), x.expandValue(iter.Value()))
+		}
 
-	if len(Version) > 1 {
-		fmt.Fprintf(writer, "minor_version = %v\n", Version[1])
+		return ret
 	}
 
-	if len(Version) > 2 {
-		fmt.Fprintf(writer, "micro_version = %v\n", Version[2])
-	}
+	return v
+}
 
-	io.WriteString(writer, "\n")
+func readDefaults(filename string) (map[string][]string, error) {
+	b, err := os.ReadFile(filename)
 
-	target := Target
+	if err != nil {
+		return nil, err
+	}
 
-	if len(target) == 0 {
-		pc := make([]uintptr, 3)
-		n := runtime.Callers(1, pc)
+	ret := make(map[string][]string)
 
-		me, _ := runtime.FuncForPC(pc[0]).FileLine(pc[0])
+	if path.Ext(filename) == ".json" {
+		var values map[string]interface{}
 
-		for i := 1; i < n; i++ {
-			f := runtime.FuncForPC(pc[i])
-			fname, _ := f.FileLine(pc[i])
+		if err := json.Unmarshal(b, &values); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
 
-			if fname != me {
-				target = path.Base(path.Dir(fname))
-				break
+		for name, v := range values {
+			if items, ok := v.([]interface{}); ok {
+				for _, item := range items {
+					ret[name] = append(ret[name], fmt.Sprintf("%v", item))
+				}
+			} else {
+				ret[name] = []string{fmt.Sprintf("%v", v)}
 			}
 		}
+
+		return ret, nil
 	}
 
-	fmt.Fprintf(writer, "TARGET ?= %s\n", target)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
 
-	io.WriteString(writer, "\nSOURCES ?=")
-	io.WriteString(writer, "\nSOURCES += $(wildcard *.go)")
-	io.WriteString(writer, "\nSOURCES_UNIQUE = $(sort $(SOURCES))")
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' || line[0] == '[' {
+			continue
+		}
 
-	io.WriteString(writer, "\n\n")
+		parts := strings.SplitN(line, "=", 2)
 
-	io.WriteString(writer, "# Rules\n")
-	io.WriteString(writer, "$(TARGET): $(SOURCES_UNIQUE)\n")
-	io.WriteString(writer, "\tgo build -o $@\n\n")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected name = value", filename, i+1)
+		}
 
-	io.WriteString(writer, "clean:\n")
-	io.WriteString(writer, "\trm -f $(TARGET)\n\n")
+		name := strings.TrimSpace(parts[0])
+		ret[name] = append(ret[name], strings.TrimSpace(parts[1]))
+	}
 
-	io.WriteString(writer, "distclean: clean\n\n")
+	return ret, nil
+}
 
-	io.WriteString(writer, "$(TARGET)_installdir ?= $(bindir)\n\n")
+// loadDefaults sets the defaults of the options of parser to the values in
+// DefaultsFile, if it exists. The names of the options found in the file are
+// returned.
+func loadDefaults(parser *flags.Parser) (map[string]bool, error) {
+	if len(DefaultsFile) == 0 {
+		return nil, nil
+	}
 
-	io.WriteString(writer, "install: $(TARGET)\n")
-	io.WriteString(writer, "\tmkdir -p $(DESTDIR)$($(TARGET)_installdir) && cp $(TARGET) $(DESTDIR)$($(TARGET)_installdir)/$(TARGET)\n\n")
+	values, err := readDefaults(DefaultsFile)
 
-	io.WriteString(writer, "uninstall:\n")
-	io.WriteString(writer, "\trm -f $(DESTDIR)$($(TARGET)_installdir)/$(TARGET)\n\n")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
 
-	io.WriteString(writer, ".PHONY: install uninstall distclean clean")
+	options := make(map[string]*flags.Option)
+
+	eachGroup(parser.Command.Group, func(g *flags.Group) {
+		for _, option := range g.Options() {
+			if name := optionName(option); len(name) > 0 {
+				options[name] = option
+			}
+		}
+	})
+
+	loaded := make(map[string]bool)
+
+	for name, v := range values {
+		option, ok := options[name]
+
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown option %s", DefaultsFile, name)
+		}
+
+		option.Default = v
+		loaded[name] = true
+	}
+
+	return loaded, nil
+}
+
+// checkArguments returns an error in strict mode if args contains positional
+// arguments. Unknown flags (which are also returned by the parser) are
+// ignored.
+func checkArguments(args []string) error {
+	if !Strict {
+		return nil
+	}
+
+	var positional []string
+
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			positional = append(positional, arg)
+		}
+	}
+
+	if len(positional) != 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(positional, " "))
+	}
+
+	return nil
+}
+
+// saveDefaults writes the unexpanded values of all options to DefaultsFile,
+// in the format read by loadDefaults.
+func (x *Config) saveDefaults() error {
+	if len(DefaultsFile) == 0 {
+		return fmt.Errorf("cannot save defaults, DefaultsFile is not set")
+	}
+
+	values := make(map[string][]string)
+
+	for _, name := range x.optionNames() {
+		v := reflect.ValueOf(x.valuesMap[name].Value())
+
+		switch v.Kind() {
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < v.Len(); i++ {
+				values[name] = append(values[name], fmt.Sprintf("%v", v.Index(i).Interface()))
+			}
+		case reflect.Map:
+			iter := v.MapRange()
+
+			for iter.Next() {
+				values[name] = append(values[name], fmt.Sprintf("%v:%v", iter.Key().Interface(), iter.Value().Interface()))
+			}
+
+			sort.Strings(values[name])
+		default:
+			values[name] = []string{fmt.Sprintf("%v", v.Interface())}
+		}
+	}
+
+	var buf bytes.Buffer
+
+	if path.Ext(DefaultsFile) == ".json" {
+		b, err := json.MarshalIndent(values, "", "\t")
+
+		if err != nil {
+			return err
+		}
+
+		buf.Write(b)
+		buf.WriteString("\n")
+	} else {
+		for _, name := range x.optionNames() {
+			for _, v := range values[name] {
+				fmt.Fprintf(&buf, "%s = %s\n", name, v)
+			}
+		}
+	}
+
+	return writeFile(DefaultsFile, buf.Bytes())
+}
+
+// optionDefaults returns the default values of all string options. It should
+// be called before parsing.
+func optionDefaults(parser *flags.Parser) map[string]string {
+	ret := make(map[string]string)
+
+	eachGroup(parser.Command.Group, func(g *flags.Group) {
+		for _, option := range g.Options() {
+			s, ok := option.Value().(string)
+
+			name := optionName(option)
+
+			if !ok || len(name) == 0 {
+				continue
+			}
+
+			if len(option.Default) > 0 {
+				s = option.Default[0]
+			}
+
+			ret[name] = s
+		}
+	})
+
+	return ret
+}
+
+// generateBuildID returns a hash of the application version, the current git
+// commit and the option values.
+func (x *Config) generateBuildID() string {
+	commit, _ := exec.Command("git", "rev-parse", "HEAD").Output()
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s\n", x.versionString(), bytes.TrimSpace(commit))
+
+	for _, name := range x.optionNames() {
+		fmt.Fprintf(h, "%s=%v\n", name, x.valuesMap[name].Value())
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func newConfig(parser *flags.Parser, builtin *flags.Group, defaults map[string]string) (*Config, error) {
+	ret := &Config{
+		Parser:   parser,
+		defaults: defaults,
+		builtin:  builtin,
+		buildID:  BuildID,
+	}
+
+	if err := ret.checkDuplicates(); err != nil {
+		return nil, err
+	}
+
+	ret.values, ret.valuesMap = ret.extract()
+
+	if builtin != nil {
+		if option := builtin.FindOptionByLongName("version-suffix"); option != nil {
+			ret.versionSuffix = option.Value().(string)
+		}
+	}
+
+	if len(ret.buildID) == 0 {
+		ret.buildID = ret.generateBuildID()
+	}
+
+	if EmptyValues == EmptyValueError {
+		for _, opt := range ret.values {
+			if s, ok := opt.Value().(string); ok && len(s) == 0 && len(defaults[optionName(opt)]) != 0 {
+				return nil, fmt.Errorf("option %s must not be empty", flagNames(opt))
+			}
+		}
+	}
+
+	ret.expanded = ret.expand()
+
+	return ret, nil
+}
+
+// EnabledOutputs returns the kinds of files which will be generated by
+// Configure, based on the current values of the package variables. Possible
+// kinds are "goconfig", "makefile", "wrapper", "ninja", "cmake", "rpmspec",
+// "shell" and "markdown".
+func EnabledOutputs() []string {
+	var ret []string
+
+	if (len(GoConfig) != 0 || len(GoConfigPackages) != 0) && !WrapperOnly {
+		ret = append(ret, "goconfig")
+	}
+
+	if len(Makefile) != 0 {
+		if !WrapperOnly {
+			ret = append(ret, "makefile")
+		}
+
+		if len(WrapperMakefile) != 0 {
+			ret = append(ret, "wrapper")
+		}
+	}
+
+	outputs := []struct {
+		Kind     string
+		Filename string
+	}{
+		{"ninja", NinjaFile},
+		{"cmake", CMakeFile},
+		{"rpmspec", RPMSpec},
+		{"shell", ShellFile},
+		{"markdown", MarkdownConfig},
+	}
+
+	for _, output := range outputs {
+		if len(output.Filename) != 0 && !WrapperOnly {
+			ret = append(ret, output.Kind)
+		}
+	}
+
+	return ret
+}
+
+// builtinOptions are the command line options of configure itself.
+type builtinOptions struct {
+	SaveDefaults  bool   `long:"save-defaults" description:"save the configured values as defaults in the defaults file"`
+	VersionSuffix string `long:"version-suffix" description:"append a suffix to the version string"`
+}
+
+type registeredOptions struct {
+	Group string
+	Data  interface{}
+}
+
+var registered []registeredOptions
+
+// RegisterOptions registers additional options, which are added by Configure
+// to the parser in a group with the given name. The data is passed to go-flags
+// like the data passed to Configure. This allows packages to contribute their
+// own configure options, typically from an init function.
+func RegisterOptions(group string, data interface{}) {
+	registered = append(registered, registeredOptions{
+		Group: group,
+		Data:  data,
+	})
+}
+
+func addRegisteredOptions(parser *flags.Parser) error {
+	for _, r := range registered {
+		if _, err := parser.AddGroup(r.Group, "", r.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type feature struct {
+	Name        string
+	Description string
+	Default     bool
+	Enabled     bool
+
+	value reflect.Value
+}
+
+var features []*feature
+
+// Feature registers an optional feature which can be enabled on the command
+// line with --enable-name and disabled with --disable-name, like gnu
+// configure. The enabled argument specifies whether the feature is enabled by
+// default. The returned value is updated by Configure. The resolved value is
+// written to the configuration as the enable-name option.
+func Feature(name string, description string, enabled bool) *bool {
+	f := &feature{
+		Name:        name,
+		Description: description,
+		Default:     enabled,
+		Enabled:     enabled,
+	}
+
+	features = append(features, f)
+	return &f.Enabled
+}
+
+type optionalPackage struct {
+	Name        string
+	Description string
+	Default     string
+	Value       string
+
+	value reflect.Value
+}
+
+var packages []*optionalPackage
+
+// WithPackage registers an optional package which can be specified on the
+// command line with --with-name[=value] and --without-name, like gnu
+// configure. The value is "yes" for --with-name without a value and "no" for
+// --without-name. The value argument specifies the default value. The
+// returned value is updated by Configure. The resolved value is written to
+// the configuration as the with-name option.
+func WithPackage(name string, description string, value string) *string {
+	p := &optionalPackage{
+		Name:        name,
+		Description: description,
+		Default:     value,
+		Value:       value,
+	}
+
+	packages = append(packages, p)
+	return &p.Value
+}
+
+// optionField returns a struct field for an option with the given long name,
+// description and additional struct tags.
+func optionField(name string, description string, typ reflect.Type, tags string) (reflect.StructField, error) {
+	field := goFieldName(name)
+
+	if !token.IsIdentifier(field) {
+		return reflect.StructField{}, fmt.Errorf("invalid option name %s", name)
+	}
+
+	return reflect.StructField{
+		Name: field,
+		Type: typ,
+		Tag:  reflect.StructTag(fmt.Sprintf("long:%q description:%q %s", name, description, tags)),
+	}, nil
+}
+
+// addFeatures adds the options for all registered features and optional
+// packages to parser. The options are fields of structs created for this
+// purpose. The --without-name and --disable-name options are callbacks
+// resetting the corresponding --with-name and --enable-name options.
+func addFeatures(parser *flags.Parser) error {
+	if len(packages) != 0 {
+		var fields []reflect.StructField
+
+		for _, p := range packages {
+			with, err := optionField("with-"+p.Name, p.Description, reflect.TypeOf(""), `optional:"yes" optional-value:"yes"`)
+
+			if err != nil {
+				return err
+			}
+
+			without, err := optionField("without-"+p.Name, fmt.Sprintf("do not %s", p.Description), reflect.TypeOf(func() {}), "")
+
+			if err != nil {
+				return err
+			}
+
+			fields = append(fields, with, without)
+		}
+
+		v := reflect.New(reflect.StructOf(fields))
+
+		for i, p := range packages {
+			with := v.Elem().Field(2 * i)
+			with.SetString(p.Default)
+
+			p.value = with
+
+			v.Elem().Field(2*i + 1).Set(reflect.ValueOf(func() {
+				with.SetString("no")
+			}))
+		}
+
+		if _, err := parser.AddGroup("Optional Packages", "", v.Interface()); err != nil {
+			return err
+		}
+	}
+
+	if len(features) == 0 {
+		return nil
+	}
+
+	var fields []reflect.StructField
+
+	for _, f := range features {
+		enable, err := optionField("enable-"+f.Name, f.Description, reflect.TypeOf(false), "")
+
+		if err != nil {
+			return err
+		}
+
+		disable, err := optionField("disable-"+f.Name, fmt.Sprintf("do not %s", f.Description), reflect.TypeOf(func() {}), "")
+
+		if err != nil {
+			return err
+		}
+
+		fields = append(fields, enable, disable)
+	}
+
+	v := reflect.New(reflect.StructOf(fields))
+
+	for i, f := range features {
+		enabled := v.Elem().Field(2 * i)
+		enabled.SetBool(f.Default)
+
+		f.value = enabled
+
+		v.Elem().Field(2*i + 1).Set(reflect.ValueOf(func() {
+			enabled.SetBool(false)
+		}))
+	}
+
+	_, err := parser.AddGroup("Optional Features", "", v.Interface())
+	return err
+}
+
+// updateFeatures updates the values returned by Feature and WithPackage to
+// the parsed values of their options.
+func updateFeatures() {
+	for _, p := range packages {
+		if p.value.IsValid() {
+			p.Value = p.value.String()
+		}
+	}
+
+	for _, f := range features {
+		if f.value.IsValid() {
+			f.Enabled = f.value.Bool()
+		}
+	}
+}
+
+// NewConfig parses the command line options as provided by the given data
+// variable and returns the resulting configuration, without writing any
+// files. Files can then be generated explicitly, for example using
+// GenerateGoConfig and GenerateMakefile. If data is nil, the default options
+// will be used (see NewOptions). Note that the data provided is simply passed
+// to go-flags. For more information on flags parsing, see the documentation of
+// go-flags. If data is an *Options, its options are shown in an "Installation
+// directories" group in the help. When embedding Options in another struct,
+// use a group tag to achieve the same.
+//
+// Unless data defines a --version option itself, the --version option prints
+// the application version and, similar to --help, a flags.Error of type
+// flags.ErrHelp is returned. The --version-suffix option appends to the
+// version string of the returned configuration.
+func NewConfig(data interface{}) (*Config, error) {
+	return newParsedConfig(data, func(parser *flags.Parser) ([]string, error) {
+		return parser.Parse()
+	})
+}
+
+// NewConfigFromJSON is like NewConfig, but reads the option values from the
+// JSON object in r instead of parsing the command line. The object maps long
+// option names (or field names) to values. Arrays specify multiple values and
+// objects specify key:value pairs of map options. Boolean options are set by
+// true, and features and optional packages are disabled by false.
+func NewConfigFromJSON(data interface{}, r io.Reader) (*Config, error) {
+	var values map[string]interface{}
+
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&values); err != nil {
+		return nil, fmt.Errorf("could not read json options: %s", err)
+	}
+
+	return newParsedConfig(data, func(parser *flags.Parser) ([]string, error) {
+		args, err := jsonArguments(parser, values)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return parser.ParseArgs(args)
+	})
+}
+
+// jsonArguments converts the option values read from JSON to the equivalent
+// command line arguments.
+func jsonArguments(parser *flags.Parser, values map[string]interface{}) ([]string, error) {
+	options := make(map[string]*flags.Option)
+
+	eachGroup(parser.Command.Group, func(g *flags.Group) {
+		for _, option := range g.Options() {
+			if name := optionName(option); len(name) > 0 {
+				options[name] = option
+			}
+		}
+	})
+
+	// Options can also be specified by field name
+	for _, option := range options {
+		if name := option.Field().Name; len(name) != 0 {
+			if _, ok := options[name]; !ok {
+				options[name] = option
+			}
+		}
+	}
+
+	names := make([]string, 0, len(values))
+
+	for name := range values {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var args []string
+
+	for _, name := range names {
+		option, ok := options[name]
+
+		if !ok {
+			return nil, fmt.Errorf("unknown option %s", name)
+		}
+
+		// Values are attached to long flags, so that they are not mistaken
+		// for flags themselves and optional values are not left out
+		flag := func(value string) []string {
+			if len(option.LongName) == 0 {
+				return []string{"-" + string(option.ShortName), value}
+			}
+
+			return []string{"--" + option.LongName + "=" + value}
+		}
+
+		switch v := values[name].(type) {
+		case nil:
+		case bool:
+			if v {
+				if len(option.LongName) == 0 {
+					args = append(args, "-"+string(option.ShortName))
+				} else {
+					args = append(args, "--"+option.LongName)
+				}
+			} else if strings.HasPrefix(option.LongName, "enable-") {
+				args = append(args, "--disable-"+strings.TrimPrefix(option.LongName, "enable-"))
+			} else if strings.HasPrefix(option.LongName, "with-") {
+				args = append(args, "--without-"+strings.TrimPrefix(option.LongName, "with-"))
+			}
+		case []interface{}:
+			for _, item := range v {
+				args = append(args, flag(fmt.Sprintf("%v", item))...)
+			}
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+
+			for key := range v {
+				keys = append(keys, key)
+			}
+
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				args = append(args, flag(fmt.Sprintf("%s:%v", key, v[key]))...)
+			}
+		default:
+			args = append(args, flag(fmt.Sprintf("%v", v))...)
+		}
+	}
+
+	return args, nil
+}
+
+// newParsedConfig creates the configuration for the options provided by data,
+// using parse to set their values.
+func newParsedConfig(data interface{}, parse func(parser *flags.Parser) ([]string, error)) (*Config, error) {
+	if data == nil {
+		data = NewOptions()
+	}
+
+	var parser *flags.Parser
+
+	var parserOptions flags.Options = flags.PrintErrors | flags.IgnoreUnknown
+
+	if Quiet {
+		parserOptions = flags.IgnoreUnknown
+	}
+
+	// The standard directory options are shown in their own group in the
+	// help, similar to gnu configure
+	if options, ok := data.(*Options); ok {
+		parser = flags.NewParser(nil, parserOptions)
+
+		if _, err := parser.AddGroup("Installation directories", "", options); err != nil {
+			return nil, err
+		}
+	} else {
+		parser = flags.NewParser(data, parserOptions)
+	}
+
+	builtin := &builtinOptions{}
+	builtinGroup, err := parser.AddGroup("Configure Options", "", builtin)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addRegisteredOptions(parser); err != nil {
+		return nil, err
+	}
+
+	if err := addFeatures(parser); err != nil {
+		return nil, err
+	}
+
+	var version bool
+
+	// Applications may define their own --version option
+	if parser.FindOptionByLongName("version") == nil {
+		builtinGroup.AddOption(&flags.Option{
+			LongName:    "version",
+			Description: "print the version and exit",
+		}, &version)
+	}
+
+	loaded, err := loadDefaults(parser)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := optionDefaults(parser)
+
+	args, err := parse(parser)
+
+	if err != nil {
+		return nil, err
+	}
+
+	updateFeatures()
+
+	if version {
+		fmt.Println(versionString() + builtin.VersionSuffix)
+
+		return nil, &flags.Error{
+			Type:    flags.ErrHelp,
+			Message: versionString() + builtin.VersionSuffix,
+		}
+	}
+
+	if err := checkArguments(args); err != nil {
+		return nil, err
+	}
+
+	ret, err := newConfig(parser, builtinGroup, defaults)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret.loaded = loaded
+	ret.save = builtin.SaveDefaults
+
+	if err := ret.checkVariables(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// Configure runs the configure process with options as provided by the given
+// data variable (see NewConfig). If GoConfig is not empty, then the go
+// configuration will be formatted with gofmt and written to the GoConfig file.
+// Similarly, if Makefile is not empty, the Makefile will be written. The same
+// holds for the NinjaFile, CMakeFile, RPMSpec, ShellFile and MarkdownConfig
+// files. All files are written relative to OutputDir, or to standard output
+// if their filename is Stdout. If --save-defaults is given, the configured
+// values are saved in the DefaultsFile. No files are written for --help and
+// --version.
+func Configure(data interface{}) (*Config, error) {
+	ret, err := NewConfig(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ret.generate(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// ConfigureFromJSON is like Configure, but reads the option values from the
+// JSON object in r instead of parsing the command line (see
+// NewConfigFromJSON).
+func ConfigureFromJSON(data interface{}, r io.Reader) (*Config, error) {
+	ret, err := NewConfigFromJSON(data, r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ret.generate(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// generate writes all the configured files, see Configure.
+func (x *Config) generate() error {
+	if x.save {
+		if err := x.saveDefaults(); err != nil {
+			return err
+		}
+	}
+
+	var generated []string
+
+	if (len(GoConfig) != 0 || len(GoConfigPackages) != 0) && !WrapperOnly {
+		if Strict {
+			if err := x.ValidateGoConfig(); err != nil {
+				return err
+			}
+		}
+
+		if err := x.GenerateGoConfig(); err != nil {
+			return err
+		}
+
+		if len(GoConfig) != 0 {
+			generated = append(generated, goConfigFilename())
+		}
+
+		for filename := range GoConfigPackages {
+			generated = append(generated, filename)
+		}
+	}
+
+	if len(Makefile) != 0 {
+		if !WrapperOnly {
+			if err := x.GenerateMakefile(); err != nil {
+				return err
+			}
+
+			generated = append(generated, Makefile)
+		}
+
+		if len(WrapperMakefile) != 0 && Makefile != Stdout {
+			ok, err := generateWrapper()
+
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				generated = append(generated, path.Join(path.Dir(Makefile), WrapperMakefile))
+			}
+		}
+	}
+
+	outputs := []struct {
+		Filename string
+		Write    func(io.Writer)
+	}{
+		{NinjaFile, x.WriteNinja},
+		{CMakeFile, x.WriteCMake},
+		{RPMSpec, x.WriteRPMSpec},
+		{ShellFile, x.WriteShell},
+		{MarkdownConfig, x.WriteMarkdownConfig},
+	}
+
+	for _, output := range outputs {
+		if len(output.Filename) != 0 && !WrapperOnly {
+			var buf bytes.Buffer
+
+			output.Write(&buf)
+
+			if err := writeOutput(output.Filename, buf.Bytes()); err != nil {
+				return err
+			}
+
+			generated = append(generated, output.Filename)
+		}
+	}
+
+	if WriteGitignore {
+		if err := writeGitignore(generated); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeGitignore adds the given files, relative to OutputDir, to the
+// .gitignore file in OutputDir, unless they are already listed.
+func writeGitignore(filenames []string) error {
+	filename := path.Join(OutputDir, ".gitignore")
+	existing, err := os.ReadFile(filename)
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	listed := make(map[string]bool)
+
+	for _, line := range strings.Split(string(existing), "\n") {
+		listed[strings.TrimSpace(line)] = true
+	}
+
+	var buf bytes.Buffer
+
+	buf.Write(existing)
+
+	if len(existing) != 0 && !bytes.HasSuffix(existing, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+
+	sort.Strings(filenames)
+
+	for _, name := range filenames {
+		if name == Stdout || listed[name] {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "%s\n", name)
+		listed[name] = true
+	}
+
+	return writeFile(filename, buf.Bytes())
+}
+
+// writeFile writes b to filename, creating its directory if needed. The file
+// is left untouched if its contents are already equal to b, so that its
+// modification time is preserved.
+func writeFile(filename string, b []byte) error {
+	if existing, err := os.ReadFile(filename); err == nil && bytes.Equal(existing, b) {
+		return nil
+	}
+
+	if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filename)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// writeOutput writes b to the output file with the given name in OutputDir,
+// or to standard output if the name is Stdout.
+func writeOutput(filename string, b []byte) error {
+	if filename == Stdout {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+
+	return writeFile(path.Join(OutputDir, filename), b)
+}
+
+// GenerateGoConfig writes the go configuration (see WriteGoConfig) to the
+// GoConfig file in OutputDir, formatted with gofmt. The GoConfigSuffix is
+// added to the filename if needed. A go configuration is also written for
+// each of the GoConfigPackages.
+func (x *Config) GenerateGoConfig() error {
+	if len(GoConfig) != 0 {
+		b, err := x.formatGoConfig(Package)
+
+		if err != nil {
+			return err
+		}
+
+		if err := writeOutput(goConfigFilename(), b); err != nil {
+			return err
+		}
+	}
+
+	filenames := make([]string, 0, len(GoConfigPackages))
+
+	for filename := range GoConfigPackages {
+		filenames = append(filenames, filename)
+	}
+
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		b, err := x.formatGoConfig(GoConfigPackages[filename])
+
+		if err != nil {
+			return err
+		}
+
+		if err := writeOutput(filename, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GoConfigString returns the go configuration (see WriteGoConfig), formatted
+// with gofmt. If the go configuration cannot be formatted, it is returned
+// unformatted.
+func (x *Config) GoConfigString() string {
+	b, err := x.formatGoConfig(Package)
+
+	if err != nil {
+		var buf bytes.Buffer
+
+		x.WriteGoConfig(&buf)
+		return buf.String()
+	}
+
+	return string(b)
+}
+
+// MakefileString returns the Makefile (see WriteMakefile).
+func (x *Config) MakefileString() string {
+	var buf bytes.Buffer
+
+	x.WriteMakefile(&buf)
+	return buf.String()
+}
+
+// GenerateMakefile writes the Makefile (see WriteMakefile) to the Makefile
+// file in OutputDir.
+func (x *Config) GenerateMakefile() error {
+	var buf bytes.Buffer
+
+	x.WriteMakefile(&buf)
+
+	if err := writeOutput(Makefile, buf.Bytes()); err != nil {
+		return err
+	}
+
+	if Makefile == Stdout {
+		return nil
+	}
+
+	return os.Chmod(path.Join(OutputDir, Makefile), 0755)
+}
+
+// Changed returns whether generating the GoConfig and Makefile files would
+// change their contents on disk. Files which do not exist yet are considered
+// changed, files written to Stdout are not.
+func (x *Config) Changed() (bool, error) {
+	files := make(map[string][]byte)
+
+	if len(GoConfig) != 0 && !WrapperOnly {
+		b, err := x.formatGoConfig(Package)
+
+		if err != nil {
+			return false, err
+		}
+
+		files[goConfigFilename()] = b
+	}
+
+	if len(Makefile) != 0 && !WrapperOnly {
+		var buf bytes.Buffer
+
+		x.WriteMakefile(&buf)
+		files[Makefile] = buf.Bytes()
+	}
+
+	for filename, data := range files {
+		if filename == Stdout {
+			continue
+		}
+
+		b, err := os.ReadFile(path.Join(OutputDir, filename))
+
+		if os.IsNotExist(err) {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		if !bytes.Equal(b, data) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// generateWrapper creates the WrapperMakefile including the Makefile file,
+// next to it, unless it already exists. It returns whether the wrapper
+// contains the generated contents, which is not the case if it already
+// existed with different contents.
+func generateWrapper() (bool, error) {
+	dir := path.Dir(path.Join(OutputDir, Makefile))
+	filename := path.Join(dir, WrapperMakefile)
+	contents := fmt.Sprintf("include %s\n", path.Base(Makefile))
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+
+	f, err := os.OpenFile(filename,
+		os.O_CREATE|os.O_EXCL|os.O_WRONLY,
+		0644)
+
+	if err != nil {
+		if os.IsExist(err) {
+			existing, err := os.ReadFile(filename)
+			return err == nil && string(existing) == contents, nil
+		}
+
+		return false, err
+	}
+
+	if _, err := io.WriteString(f, contents); err != nil {
+		f.Close()
+		return false, err
+	}
+
+	return true, f.Close()
+}
+
+// Sources of option values, see Config.Source.
+const (
+	SourceDefault      = "default"
+	SourceDefaultsFile = "defaults file"
+	SourceFlag         = "flag"
+)
+
+// Source returns where the value of the option with the given name came from:
+// SourceFlag if it was specified on the command line, SourceDefaultsFile if
+// it was read from the DefaultsFile and SourceDefault otherwise.
+func (x *Config) Source(name string) string {
+	if option, ok := x.valuesMap[name]; ok && option.IsSet() && !option.IsSetDefault() {
+		return SourceFlag
+	}
+
+	if x.loaded[name] {
+		return SourceDefaultsFile
+	}
+
+	return SourceDefault
+}
+
+// SetPrefix changes the value of the prefix option and expands all variables
+// again, so that all directories relative to the prefix are updated. The
+// build ID is generated again, unless BuildID is set. An error is returned if
+// there is no prefix option, or if the new prefix cannot be written (in which
+// case the configuration is left unchanged).
+func (x *Config) SetPrefix(prefix string) error {
+	option, ok := x.valuesMap["prefix"]
+
+	if !ok {
+		return fmt.Errorf("no prefix option")
+	}
+
+	old := fmt.Sprintf("%v", option.Value())
+
+	update := func(value string) error {
+		if err := option.Set(&value); err != nil {
+			return err
+		}
+
+		if len(BuildID) == 0 {
+			x.buildID = x.generateBuildID()
+		}
+
+		x.expanded = x.expand()
+		return nil
+	}
+
+	if err := update(prefix); err != nil {
+		return err
+	}
+
+	if err := x.checkVariables(); err != nil {
+		update(old)
+		return err
+	}
+
+	return nil
+}
+
+// Raw returns the unexpanded value of the option with the given long name,
+// and whether the option exists. Slices and maps are copied, so that
+// modifying the result does not affect the option.
+func (x *Config) Raw(name string) (interface{}, bool) {
+	option, ok := x.valuesMap[name]
+
+	if !ok {
+		return nil, false
+	}
+
+	if _, ok := x.expanded[name]; ok {
+		return x.rawValues()[name], true
+	}
+
+	return copyValue(reflect.ValueOf(option.Value())).Interface(), true
+}
+
+// copyValue returns a copy of v, copying slices and maps (but not their
+// elements).
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+
+		ret := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(ret, v)
+
+		return ret
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+
+		ret := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+
+		for iter.Next() {
+			ret.SetMapIndex(iter.Key(), iter.Value())
+		}
+
+		return ret
+	}
+
+	return v
+}
+
+// Expand expands the variable value indicated by name
+func (x *Config) Expand(name string) string {
+	return x.expanded[name].expand(x.expanded)
+}
+
+// Dependencies returns the sorted list of names of all variables the value
+// of the variable indicated by name (transitively) depends on.
+func (x *Config) Dependencies(name string) []string {
+	es, ok := x.expanded[name]
+
+	if !ok {
+		return nil
+	}
+
+	es.expand(x.expanded)
+
+	ret := make([]string, 0, len(es.dependencies))
+
+	for i, dep := range es.dependencies {
+		if i == 0 || dep != es.dependencies[i-1] {
+			ret = append(ret, dep)
+		}
+	}
+
+	return ret
+}
+
+// MarshalJSON marshals the configuration as a JSON object mapping the long
+// name of each option to its expanded value. The application version is
+// stored under the "version" key.
+func (x *Config) MarshalJSON() ([]byte, error) {
+	ret := make(map[string]interface{})
+
+	for name, opt := range x.valuesMap {
+		if _, ok := x.expanded[name]; ok {
+			ret[name] = x.Expand(name)
+		} else {
+			ret[name] = x.expandValue(reflect.ValueOf(opt.Value())).Interface()
+		}
+	}
+
+	ret["version"] = Version
+
+	return json.Marshal(ret)
+}
+
+// InstallDir returns the expanded installation directory for the given kind
+// of file. The kind is the name of a directory option without its "dir"
+// suffix (for example "bin", "man", "data" or "sysconf"). An empty string is
+// returned if no such directory option exists.
+func (x *Config) InstallDir(kind string) string {
+	name := kind + "dir"
+
+	if _, ok := x.expanded[name]; !ok {
+		return ""
+	}
+
+	return x.Expand(name)
+}
+
+// RelPath returns the relative path from the expanded directory of the
+// fromLongname option to the expanded directory of the toLongname option (for
+// example from bindir to libdir).
+func (x *Config) RelPath(fromLongname, toLongname string) (string, error) {
+	for _, name := range []string{fromLongname, toLongname} {
+		if _, ok := x.expanded[name]; !ok {
+			return "", fmt.Errorf("unknown directory option %s", name)
+		}
+	}
+
+	return filepath.Rel(x.Expand(fromLongname), x.Expand(toLongname))
+}
+
+// flagNames returns the command line flags of option, for example
+// "-p, --prefix".
+func flagNames(option *flags.Option) string {
+	if option.ShortName == 0 {
+		return "--" + option.LongName
+	}
+
+	if len(option.LongName) == 0 {
+		return fmt.Sprintf("-%c", option.ShortName)
+	}
+
+	return fmt.Sprintf("-%c, --%s", option.ShortName, option.LongName)
+}
+
+// goFieldName returns the go config struct field name for the given long
+// option name, for example Prefix for prefix and EnableDocs for enable-docs.
+func goFieldName(name string) string {
+	parts := strings.Split(name, "-")
+
+	for i, part := range parts {
+		parts[i] = strings.Title(part)
+	}
+
+	return strings.Join(parts, "")
+}
+
+// goConfigReserved are the names of the fields written to the go config in
+// addition to the options.
+var goConfigReserved = []string{"Version", "VersionString", "BuildID"}
+
+// goConfigFieldName returns the go config struct field name of the option
+// with the given long name (see goFieldName). Options which would conflict
+// with one of the goConfigReserved fields get an Option suffix, for example
+// VersionOption for a version option.
+func goConfigFieldName(name string) string {
+	field := goFieldName(name)
+
+	for _, reserved := range goConfigReserved {
+		if field == reserved {
+			return field + "Option"
+		}
+	}
+
+	return field
+}
+
+// writeGoConfigFields writes the struct fields of the go configuration and
+// returns the corresponding values.
+func (x *Config) writeGoConfigFields(writer io.Writer) []string {
+	values := make([]string, 0)
+	raw := x.cleanValues()
+
+	// Write all options
+	for _, name := range x.optionNames() {
+		option := x.valuesMap[name]
+		val := option.Value()
+
+		var v reflect.Value
+
+		if _, ok := x.expanded[name]; ok {
+			if GoConfigExpand {
+				v = reflect.ValueOf(x.Expand(name))
+			} else {
+				v = reflect.ValueOf(raw[name])
+			}
+		} else if GoConfigExpand {
+			v = x.expandValue(reflect.ValueOf(val))
+		} else {
+			v = reflect.ValueOf(val)
+		}
+
+		if converted, ok, err := x.convertValue(name); ok && err == nil {
+			v = reflect.ValueOf(converted)
+		}
+
+		empty := false
+
+		switch v.Kind() {
+		case reflect.String, reflect.Slice, reflect.Map:
+			empty = v.Len() == 0
+		}
+
+		if empty && GoConfigOmitEmpty {
+			continue
+		}
+
+		if len(values) != 0 {
+			io.WriteString(writer, "\n")
+		}
+
+		if len(option.Description) != 0 {
+			fmt.Fprintf(writer, "\t// %s: %s\n", flagNames(option), option.Description)
+
+			if empty {
+				io.WriteString(writer, "\t//\n")
+			}
+		}
+
+		if empty {
+			io.WriteString(writer, "\t// Note: resolved to an empty value\n")
+		}
+
+		if GoConfigSources {
+			switch x.Source(name) {
+			case SourceFlag:
+				fmt.Fprintf(writer, "\t// from %s flag\n", flagNames(option))
+			case SourceDefaultsFile:
+				fmt.Fprintf(writer, "\t// from %s\n", DefaultsFile)
+			default:
+				io.WriteString(writer, "\t// default\n")
+			}
+		}
+
+		fmt.Fprintf(writer, "\t%v %s\n", goConfigFieldName(name), v.Type())
+
+		values = append(values, fmt.Sprintf("%#v", v.Interface()))
+	}
+
+	if len(values) > 0 {
+		io.WriteString(writer, "\n")
+	}
+
+	io.WriteString(writer, "\t// Application version\n")
+	io.WriteString(writer, "\tVersion []int\n\n")
+	io.WriteString(writer, "\t// Application version string, including VersionSuffix\n")
+	io.WriteString(writer, "\tVersionString string\n\n")
+	io.WriteString(writer, "\t// Build ID\n")
+	io.WriteString(writer, "\tBuildID string\n")
+
+	return values
+}
+
+// WriteGoConfig writes the go configuration file containing all the variable
+// values to the given writer, starting with a comment marking it as generated
+// code. Besides the variables, the configuration contains the application
+// Version, its dotted VersionString and the BuildID. Note that it will write
+// a package line if the Package variable is not empty, preceded by build
+// constraints if GoConfigBuildTags is not empty. The GoConfigVariable name
+// will be used as the variable name for the configuration. If
+// GoConfigFragment is set, only the struct fields are written.
+func (x *Config) WriteGoConfig(writer io.Writer) {
+	x.writeGoConfig(writer, Package)
+}
+
+func (x *Config) writeGoConfig(writer io.Writer, pkg string) {
+	if GoConfigFragment {
+		x.writeGoConfigFields(writer)
+		return
+	}
+
+	io.WriteString(writer, "// Code generated by go-configure; DO NOT EDIT.\n\n")
+
+	if len(GoConfigBuildTags) > 0 {
+		fmt.Fprintf(writer, "//go:build %s\n", strings.Join(GoConfigBuildTags, " && "))
+		fmt.Fprintf(writer, "// +build %s\n\n", strings.Join(GoConfigBuildTags, ","))
+	}
+
+	if len(pkg) > 0 {
+		fmt.Fprintf(writer, "package %v\n\n", pkg)
+	}
+
+	var imports []string
+
+	if GoConfigBuildInfo {
+		imports = append(imports, "runtime/debug")
+	}
+
+	if !GoConfigExpand {
+		imports = append(imports, "regexp", "strings")
+	}
+
+	if len(imports) == 1 {
+		fmt.Fprintf(writer, "import %q\n\n", imports[0])
+	} else if len(imports) > 1 {
+		io.WriteString(writer, "import (\n")
+
+		for _, imp := range imports {
+			fmt.Fprintf(writer, "\t%q\n", imp)
+		}
+
+		io.WriteString(writer, ")\n\n")
+	}
+
+	fmt.Fprintf(writer, "var %s = struct {\n", GoConfigVariable)
+	values := x.writeGoConfigFields(writer)
+	fmt.Fprintln(writer, "}{")
+
+	for _, v := range values {
+		fmt.Fprintf(writer, "\t%v,\n", v)
+	}
+
+	fmt.Fprintf(writer, "\t%#v,\n", Version)
+	fmt.Fprintf(writer, "\t%#v,\n", x.versionString())
+	fmt.Fprintf(writer, "\t%#v,\n", x.Expand("buildid"))
+	fmt.Fprintln(writer, "}")
+
+	if GoConfigBuildInfo {
+		fmt.Fprintf(writer, "\n// %sVersion returns the main module version embedded in the binary,\n", GoConfigVariable)
+		fmt.Fprintf(writer, "// falling back to the configured version if it is not available.\n")
+		fmt.Fprintf(writer, "func %sVersion() string {\n", GoConfigVariable)
+		io.WriteString(writer, "\tif info, ok := debug.ReadBuildInfo(); ok {\n")
+		io.WriteString(writer, "\t\tif v := info.Main.Version; len(v) != 0 && v != \"(devel)\" {\n")
+		io.WriteString(writer, "\t\t\treturn v\n")
+		io.WriteString(writer, "\t\t}\n")
+		io.WriteString(writer, "\t}\n\n")
+		fmt.Fprintf(writer, "\treturn %#v\n", x.versionString())
+		io.WriteString(writer, "}\n")
+	}
+
+	if !GoConfigExpand {
+		x.writeGoConfigExpand(writer)
+	}
+}
+
+// writeGoConfigExpand writes a function expanding variable references at
+// runtime, resolving variables to the string values of the go configuration.
+// References are expanded recursively, ignoring circular references, similar
+// to Config.Expand.
+func (x *Config) writeGoConfigExpand(writer io.Writer) {
+	// The helpers are prefixed by expand so that they never collide with
+	// the exported function, even if GoConfigVariable is unexported
+	private := "expand" + strings.ToUpper(GoConfigVariable[:1]) + GoConfigVariable[1:]
+
+	fmt.Fprintf(writer, "\nfunc %sVariables() map[string]string {\n", private)
+	io.WriteString(writer, "\treturn map[string]string{\n")
+
+	for _, name := range x.optionNames() {
+		if _, ok := x.valuesMap[name].Value().(string); ok {
+			fmt.Fprintf(writer, "\t\t%q: %s.%s,\n", name, GoConfigVariable, goConfigFieldName(name))
+		}
+	}
+
+	if _, ok := x.valuesMap["buildid"]; !ok {
+		fmt.Fprintf(writer, "\t\t\"buildid\": %s.BuildID,\n", GoConfigVariable)
+	}
+
+	// Variables can also be referenced by field name
+	aliases := x.aliases(x.rawValues())
+	names := make([]string, 0, len(aliases))
+
+	for alias := range aliases {
+		names = append(names, alias)
+	}
+
+	sort.Strings(names)
+
+	for _, alias := range names {
+		name := aliases[alias]
+
+		if _, ok := x.valuesMap[name].Value().(string); ok {
+			fmt.Fprintf(writer, "\t\t%q: %s.%s,\n", alias, GoConfigVariable, goConfigFieldName(name))
+		}
+	}
+
+	io.WriteString(writer, "\t}\n")
+	io.WriteString(writer, "}\n\n")
+
+	fmt.Fprintf(writer, "// %sExpand expands all %s variable references in s using the\n", GoConfigVariable, reference("name"))
+	fmt.Fprintf(writer, "// values of %s.\n", GoConfigVariable)
+	fmt.Fprintf(writer, "func %sExpand(s string) string {\n", GoConfigVariable)
+	fmt.Fprintf(writer, "\treturn %s(s, %sVariables(), make(map[string]bool))\n", private, private)
+	io.WriteString(writer, "}\n\n")
+
+	// References are matched like in newExpandString, so that escaped and
+	// invalid references are kept literally at runtime as well
+	fmt.Fprintf(writer, "var %sPattern = regexp.MustCompile(%q)\n\n", private, variableMatcher().String())
+
+	fmt.Fprintf(writer, "func %s(s string, variables map[string]string, expanding map[string]bool) string {\n", private)
+	io.WriteString(writer, "\tvar ret strings.Builder\n\n")
+	io.WriteString(writer, "\tlast := 0\n\n")
+	fmt.Fprintf(writer, "\tfor _, match := range %sPattern.FindAllStringSubmatchIndex(s, -1) {\n", private)
+	io.WriteString(writer, "\t\t// References preceded by a $ are kept literally\n")
+	io.WriteString(writer, "\t\tif match[3] != match[2] {\n")
+	io.WriteString(writer, "\t\t\tcontinue\n")
+	io.WriteString(writer, "\t\t}\n\n")
+	fmt.Fprintf(writer, "\t\tname := s[match[0]+%d : match[1]-%d]\n", len(ExpandOpen), len(ExpandClose))
+	io.WriteString(writer, "\t\tret.WriteString(s[last:match[0]])\n\n")
+	io.WriteString(writer, "\t\tif !expanding[name] {\n")
+	io.WriteString(writer, "\t\t\texpanding[name] = true\n")
+	fmt.Fprintf(writer, "\t\t\tret.WriteString(%s(variables[name], variables, expanding))\n", private)
+	io.WriteString(writer, "\t\t\tdelete(expanding, name)\n")
+	io.WriteString(writer, "\t\t}\n\n")
+	io.WriteString(writer, "\t\tlast = match[1]\n")
+	io.WriteString(writer, "\t}\n\n")
+	io.WriteString(writer, "\tret.WriteString(s[last:])\n")
+	io.WriteString(writer, "\treturn ret.String()\n")
+	io.WriteString(writer, "}\n")
+}
+
+// formatGoConfig returns the go configuration for the given package formatted
+// by gofmt. An error is returned if the generated source could not be parsed.
+// Fragments are returned unformatted.
+func (x *Config) formatGoConfig(pkg string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	x.writeGoConfig(&buf, pkg)
+
+	if GoConfigFragment {
+		return buf.Bytes(), nil
+	}
+
+	b, err := format.Source(buf.Bytes())
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid go config generated: %s", err)
+	}
+
+	return b, nil
+}
+
+// ValidateGoConfig checks that the go configuration compiles, by parsing and
+// type checking it. If Package is empty, the go configuration is checked as
+// part of the main package. Fragments are not checked.
+func (x *Config) ValidateGoConfig() error {
+	if GoConfigFragment {
+		return nil
+	}
+
+	pkg := Package
+
+	if len(pkg) == 0 {
+		pkg = "main"
+	}
+
+	var buf bytes.Buffer
+
+	x.writeGoConfig(&buf, pkg)
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, goConfigFilename(), buf.Bytes(), 0)
+
+	if err != nil {
+		return fmt.Errorf("invalid go config generated: %s", err)
+	}
+
+	conf := types.Config{Importer: importer.Default()}
+
+	if _, err := conf.Check(pkg, fset, []*ast.File{f}, nil); err != nil {
+		return fmt.Errorf("invalid go config generated: %s", err)
+	}
+
+	return nil
+}
+
+// optionNames returns the sorted long names of all options.
+func (x *Config) optionNames() []string {
+	ret := make([]string, 0, len(x.valuesMap))
+
+	for name := range x.valuesMap {
+		ret = append(ret, name)
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// makefileVariables returns the names of all variables written by
+// WriteMakefile, in the order in which they are written.
+func (x *Config) makefileVariables() []string {
+	var ret []string
+
+	for _, v := range x.sortedVariables() {
+		ret = append(ret, v.Name)
+	}
+
+	for _, name := range x.optionNames() {
+		if _, ok := x.expanded[name]; !ok {
+			ret = append(ret, name)
+		}
+	}
+
+	return ret
+}
+
+// checkVariables checks that the options written by WriteGoConfig are the
+// same as the options written by WriteMakefile, and that their values can be
+// written to the Makefile.
+func (x *Config) checkVariables() error {
+	names := x.optionNames()
+	written := make(map[string]bool)
+
+	raw := x.rawValues()
+
+	for _, name := range names {
+		var value string
+
+		if _, ok := x.expanded[name]; ok {
+			value = raw[name]
+		} else {
+			value = makefileValue(x.expandValue(reflect.ValueOf(x.valuesMap[name].Value())))
+		}
+
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("option %s contains a newline, which cannot be written to the Makefile", flagNames(x.valuesMap[name]))
+		}
+
+		if _, _, err := x.convertValue(name); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range x.makefileVariables() {
+		if _, ok := x.valuesMap[name]; ok {
+			written[name] = true
+		}
+	}
+
+	for _, name := range names {
+		if !written[name] {
+			return fmt.Errorf("option %s is missing from the Makefile", name)
+		}
+	}
+
+	if len(written) != len(names) {
+		return fmt.Errorf("the Makefile contains options not in the go config")
+	}
+
+	return nil
+}
+
+// makefileValue formats a non-string option value for a Makefile. Elements
+// of slices and arrays, and key:value pairs of maps, are written as
+// space separated words.
+func makefileValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		words := make([]string, v.Len())
+
+		for i := 0; i < v.Len(); i++ {
+			words[i] = makefileValue(v.Index(i))
+		}
+
+		return strings.Join(words, " ")
+	case reflect.Map:
+		words := make([]string, 0, v.Len())
+		iter := v.MapRange()
+
+		for iter.Next() {
+			words = append(words, fmt.Sprintf("%s:%s", makefileValue(iter.Key()), makefileValue(iter.Value())))
+		}
+
+		sort.Strings(words)
+		return strings.Join(words, " ")
+	}
+
+	return fmt.Sprintf("%v", v.Interface())
+}
+
+// makefileEscape escapes # in s, which would otherwise start a comment, and $,
+// which would otherwise start a variable reference.
+func makefileEscape(s string) string {
+	return strings.NewReplacer("#", "\\#", "$", "$$").Replace(s)
+}
+
+// sortedVariables returns all expanded variables, ordered such that each
+// variable comes after the variables it depends on. Variables which do not
+// depend on each other are ordered alphabetically.
+func (x *Config) sortedVariables() []*expandString {
+	vars := make([]*expandString, 0, len(x.expanded))
+	done := make(map[string]bool)
+
+	names := make([]string, 0, len(x.expanded))
+
+	for name := range x.expanded {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for len(vars) < len(names) {
+		var next *expandString
+
+		for _, name := range names {
+			if done[name] {
+				continue
+			}
+
+			v := x.expanded[name]
+			ready := true
+
+			for _, dep := range v.dependencies {
+				if _, ok := x.expanded[dep]; ok && dep != name && !done[dep] {
+					ready = false
+					break
+				}
+			}
+
+			if ready {
+				next = v
+				break
+			}
+		}
+
+		if next == nil {
+			// Circular dependency, break it at the first remaining variable
+			for _, name := range names {
+				if !done[name] {
+					next = x.expanded[name]
+					break
+				}
+			}
+		}
+
+		done[next.Name] = true
+		vars = append(vars, next)
+	}
+
+	return vars
+}
+
+// targetName returns Target, or if Target is empty, the value of the
+// CONFIGURE_TARGET environment variable. Otherwise the target is the name of
+// the directory of the first caller outside of this package, falling back to
+// the name of the working directory.
+func targetName() string {
+	target := Target
+
+	if len(target) == 0 {
+		target = os.Getenv("CONFIGURE_TARGET")
+	}
+
+	if len(target) == 0 {
+		pc := make([]uintptr, 64)
+		n := runtime.Callers(1, pc)
+		frames := runtime.CallersFrames(pc[:n])
+
+		var files []string
+
+		for {
+			frame, more := frames.Next()
+			files = append(files, frame.File)
+
+			if !more {
+				break
+			}
+		}
+
+		_, me, _, _ := runtime.Caller(0)
+		target = callerTarget(path.Dir(me), files)
+	}
+
+	if len(target) == 0 {
+		if wd, err := os.Getwd(); err == nil {
+			target = filepath.Base(wd)
+		}
+	}
+
+	return target
+}
+
+// callerTarget returns the name of the directory of the first file in files
+// which is not part of the package in dir. Test files are not considered part
+// of the package.
+func callerTarget(dir string, files []string) string {
+	for _, file := range files {
+		if path.Dir(file) == dir && !strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+
+		return path.Base(path.Dir(file))
+	}
+
+	return ""
+}
+
+// standardOptionNames returns the long names of the options in Options.
+func standardOptionNames() map[string]bool {
+	ret := make(map[string]bool)
+	typ := reflect.TypeOf(Options{})
+
+	for i := 0; i < typ.NumField(); i++ {
+		if name := typ.Field(i).Tag.Get("long"); len(name) != 0 {
+			ret[name] = true
+		}
+	}
+
+	return ret
+}
+
+// TargetName returns the name of the executable to build (see Target and
+// targetName). The name is determined on the first call and remembered.
+func (x *Config) TargetName() string {
+	if len(x.target) == 0 {
+		x.target = targetName()
+	}
+
+	return x.target
+}
+
+// WriteMakefile writes a Makefile for the given parser to the given writer.
+// The Makefile contains the common build, clean, distclean, install and
+// uninstall rules. Variable references are only expanded in string values.
+// Boolean options, such as features, are written as 1 if true and as an empty
+// value if false.
+func (x *Config) WriteMakefile(writer io.Writer) {
+	// Write a very basic makefile
+	io.WriteString(writer, "#!/usr/bin/make -f\n\n")
+
+	if len(MakefilePrologue) != 0 {
+		io.WriteString(writer, MakefilePrologue)
+		io.WriteString(writer, "\n\n")
+	}
+
+	// The standard directories are written in their own section, unless they
+	// depend on other variables (which would then be written after them)
+	standard := standardOptionNames()
+	isDir := make(map[string]bool)
+
+	var dirVars, otherVars []*expandString
+
+	for _, v := range x.sortedVariables() {
+		ok := standard[v.Name]
+
+		for _, dep := range v.dependencies {
+			ok = ok && isDir[dep]
+		}
+
+		if ok {
+			isDir[v.Name] = true
+			dirVars = append(dirVars, v)
+		} else {
+			otherVars = append(otherVars, v)
+		}
+	}
+
+	assign := "="
+
+	if MakefileConditional {
+		assign = "?="
+	}
+
+	// Options are preceded by their description, like in the go config
+	writeComment := func(name string) {
+		if option, ok := x.valuesMap[name]; ok && len(option.Description) != 0 {
+			fmt.Fprintf(writer, "# %s\n", strings.Join(strings.Fields(option.Description), " "))
+		}
+	}
+
+	writeVariable := func(v *expandString) {
+		writeComment(v.Name)
+		fmt.Fprintf(writer, "%s %s ", v.Name, assign)
+
+		for _, part := range v.Parts {
+			if part.IsVariable {
+				fmt.Fprintf(writer, "$(%s)", part.Value)
+			} else {
+				io.WriteString(writer, makefileEscape(part.Value))
+			}
+		}
+
+		io.WriteString(writer, "\n")
+	}
+
+	if len(dirVars) != 0 {
+		io.WriteString(writer, "# Installation directories\n")
+
+		for _, v := range dirVars {
+			writeVariable(v)
+		}
+
+		io.WriteString(writer, "\n")
+	}
+
+	io.WriteString(writer, "# Package options\n")
+
+	for _, v := range otherVars {
+		writeVariable(v)
+	}
+
+	for _, name := range x.optionNames() {
+		if _, ok := x.expanded[name]; ok {
+			continue
+		}
+
+		writeComment(name)
+
+		v := reflect.ValueOf(x.valuesMap[name].Value())
+
+		// Boolean options follow the make convention of a non-empty value
+		// being true, so that they can be tested using ifdef or $(if)
+		if v.Kind() == reflect.Bool {
+			if v.Bool() {
+				fmt.Fprintf(writer, "%s %s 1\n", name, assign)
+			} else {
+				fmt.Fprintf(writer, "%s %s\n", name, assign)
+			}
+
+			continue
+		}
+
+		fmt.Fprintf(writer, "%s %s %s\n", name, assign, makefileEscape(makefileValue(x.expandValue(v))))
+	}
+
+	fmt.Fprintf(writer, "version ?= %s\n", x.versionString())
+	fmt.Fprintf(writer, "major_version = %v\n", Version[0])
+
+	if len(Version) > 1 {
+		fmt.Fprintf(writer, "minor_version = %v\n", Version[1])
+	}
+
+	if len(Version) > 2 {
+		fmt.Fprintf(writer, "micro_version = %v\n", Version[2])
+	}
+
+	io.WriteString(writer, "\n")
+
+	fmt.Fprintf(writer, "TARGET ?= %s\n", x.TargetName())
+
+	io.WriteString(writer, "\nSOURCES ?=")
+	io.WriteString(writer, "\nSOURCES += $(patsubst ./%,%,$(shell find . -name '*.go'))")
+	io.WriteString(writer, "\nSOURCES_UNIQUE = $(sort $(SOURCES))")
+
+	// Tests are not needed to build the target (the generated go config is
+	// kept, since it is not a test file unless GoConfigTest is set)
+	io.WriteString(writer, "\nBUILD_SOURCES = $(filter-out %_test.go,$(SOURCES_UNIQUE))")
+
+	io.WriteString(writer, "\n\n")
+
+	io.WriteString(writer, "# Rules\n")
+	io.WriteString(writer, "$(TARGET): $(BUILD_SOURCES) ## Build the executable\n")
+
+	io.WriteString(writer, "\tgo build -o $@")
+
+	if len(BuildPackage) != 0 {
+		fmt.Fprintf(writer, " %s", BuildPackage)
+	}
+
+	io.WriteString(writer, "\n\n")
+
+	io.WriteString(writer, "clean: ## Remove the built executable\n")
+	io.WriteString(writer, "\trm -f $(TARGET)\n")
+	io.WriteString(writer, "\t$(if $(DOCOUTPUT),rm -rf $(DOCOUTPUT))\n\n")
+
+	io.WriteString(writer, "distclean: clean ## Remove all generated files\n\n")
+
+	io.WriteString(writer, "$(TARGET)_installdir ?= $(bindir)\n\n")
+
+	io.WriteString(writer, "INSTALL ?= install\n")
+	io.WriteString(writer, "BINMODE ?= 0755\n")
+	io.WriteString(writer, "DATAMODE ?= 0644\n")
+	io.WriteString(writer, "INSTALL_PROGRAM = $(INSTALL) -m $(BINMODE)\n")
+	io.WriteString(writer, "INSTALL_DATA = $(INSTALL) -m $(DATAMODE)\n\n")
+
+	// Directories are created through order-only prerequisites, using
+	// a trailing slash to match the directory rule
+	io.WriteString(writer, "%/:\n")
+	io.WriteString(writer, "\tmkdir -p $@\n\n")
+
+	io.WriteString(writer, "install: $(TARGET) | $(DESTDIR)$($(TARGET)_installdir)/ ## Install the executable\n")
+	io.WriteString(writer, "\t$(INSTALL_PROGRAM) $(TARGET) $(DESTDIR)$($(TARGET)_installdir)/$(TARGET)\n\n")
+
+	// Remove empty directories up to (but not including) the prefix
+	dirs := []string{"$(DESTDIR)$($(TARGET)_installdir)"}
+
+	if _, ok := x.expanded["datadir"]; ok {
+		dirs = append(dirs, "$(DESTDIR)$(datadir)/$(TARGET)")
+	}
+
+	io.WriteString(writer, "UNINSTALL_RMDIR ?= yes\n\n")
+	io.WriteString(writer, "uninstall: ## Uninstall the executable\n")
+	io.WriteString(writer, "\trm -f $(DESTDIR)$($(TARGET)_installdir)/$(TARGET)\n")
+	io.WriteString(writer, "ifeq ($(UNINSTALL_RMDIR),yes)\n")
+	fmt.Fprintf(writer, "\t@for dir in %s; do \\\n", strings.Join(dirs, " "))
+	io.WriteString(writer, "\t\twhile [ \"$$dir\" != \"$(DESTDIR)$(prefix)\" ] && rmdir \"$$dir\" 2>/dev/null; do dir=$$(dirname \"$$dir\"); done; \\\n")
+	io.WriteString(writer, "\tdone\n")
+	io.WriteString(writer, "endif\n\n")
+
+	io.WriteString(writer, "DISTDIR = $(TARGET)-$(version)\n\n")
+
+	// Besides the sources, the tarball needs the module files and the files
+	// embedded by go:embed directives to build
+	io.WriteString(writer, "EMBED_FILES = $(patsubst $(CURDIR)/%,%,$(shell go list -f '{{$$dir := .Dir}}{{range .EmbedFiles}}{{$$dir}}/{{.}} {{end}}' ./... 2>/dev/null))\n\n")
+	io.WriteString(writer, "DIST_FILES ?=\n")
+	io.WriteString(writer, "DIST_FILES += $(wildcard go.mod go.sum) $(EMBED_FILES)\n\n")
+
+	io.WriteString(writer, "dist: ## Create a source tarball\n")
+	io.WriteString(writer, "\trm -rf $(DISTDIR) && mkdir -p $(DISTDIR)\n")
+	io.WriteString(writer, "\ttar -cf - $(sort $(SOURCES_UNIQUE) $(DIST_FILES) $(MAKEFILE_LIST)) | (cd $(DISTDIR) && tar -xf -)\n")
+	io.WriteString(writer, "\ttar -czf $(DISTDIR).tar.gz $(DISTDIR)\n")
+	io.WriteString(writer, "\trm -rf $(DISTDIR)\n\n")
+
+	io.WriteString(writer, "DOCGEN ?= @echo \"DOCGEN is not set, no documentation generated\"\n")
+	io.WriteString(writer, "DOCOUTPUT ?=\n\n")
+
+	io.WriteString(writer, "docs: ## Build the documentation\n")
+	io.WriteString(writer, "\t$(DOCGEN)\n\n")
+
+	io.WriteString(writer, "test: ## Run the tests\n")
+	io.WriteString(writer, "\tgo test ./...\n\n")
+
+	io.WriteString(writer, "check: test ## Run the tests\n\n")
+
+	// Build and test the unpacked tarball in a temporary directory, which is
+	// removed also when building or testing fails. The makefile is passed
+	// explicitly, since it need not have one of the default names
+	io.WriteString(writer, "distcheck: dist ## Check that the source tarball builds and passes the tests\n")
+	io.WriteString(writer, "\ttmp=$$(mktemp -d) && trap 'rm -rf \"$$tmp\"' EXIT && \\\n")
+	io.WriteString(writer, "\ttar -xzf $(DISTDIR).tar.gz -C \"$$tmp\" && \\\n")
+	io.WriteString(writer, "\t$(MAKE) -C \"$$tmp/$(DISTDIR)\" -f $(firstword $(MAKEFILE_LIST)) && \\\n")
+	io.WriteString(writer, "\t$(MAKE) -C \"$$tmp/$(DISTDIR)\" -f $(firstword $(MAKEFILE_LIST)) check\n\n")
+
+	io.WriteString(writer, "ARGS ?=\n\n")
+	io.WriteString(writer, "run: $(TARGET) ## Build and run the executable with ARGS\n")
+	io.WriteString(writer, "\t./$(TARGET) $(ARGS)\n\n")
+
+	phony := []string{"install", "uninstall", "distclean", "clean", "dist", "docs", "test", "check", "distcheck", "run"}
+
+	if DockerTarget {
+		names := make([]string, 0, len(x.expanded))
+
+		for name := range x.expanded {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		io.WriteString(writer, "DOCKER ?= $(shell command -v docker 2>/dev/null)\n")
+		io.WriteString(writer, "DOCKERFILE ?= Dockerfile\n\n")
+		io.WriteString(writer, "docker: ## Build a docker image\n")
+		io.WriteString(writer, "\t$(if $(DOCKER),,$(error docker is required to build an image, install it or set DOCKER))\n")
+		io.WriteString(writer, "\t$(DOCKER) build -f $(DOCKERFILE) -t $(TARGET):$(version)")
+
+		for _, name := range names {
+			fmt.Fprintf(writer, " --build-arg %s=$(%s)", name, name)
+		}
+
+		io.WriteString(writer, " .\n\n")
+
+		phony = append(phony, "docker")
+	}
+
+	// List all targets annotated with a ## description
+	io.WriteString(writer, "help: ## Show this help\n")
+	io.WriteString(writer, "\t@grep -hE '^[^[:space:]#]+:.*## ' $(MAKEFILE_LIST) | awk -v target=$(TARGET) 'BEGIN {FS = \":.*## \"}; {gsub(/\\$$\\(TARGET\\)/, target, $$1); printf \"  %-20s %s\\n\", $$1, $$2}'\n\n")
+
+	phony = append(phony, "help")
+
+	if len(ExtraRules) != 0 {
+		io.WriteString(writer, strings.TrimRight(ExtraRules, "\n"))
+		io.WriteString(writer, "\n\n")
+	}
+
+	phony = append(phony, ExtraPhony...)
+	fmt.Fprintf(writer, ".PHONY: %s", strings.Join(phony, " "))
+
+	if len(MakefileEpilogue) != 0 {
+		io.WriteString(writer, "\n\n")
+		io.WriteString(writer, MakefileEpilogue)
+	}
+}
+
+func ninjaEscape(s string) string {
+	return strings.NewReplacer("$", "$$", "\n", "$\n").Replace(s)
+}
+
+// WriteNinja writes a ninja build file for the given parser to the given
+// writer. The build file contains the same variables as the Makefile (see
+// WriteMakefile) and the build, install and uninstall rules.
+func (x *Config) WriteNinja(writer io.Writer) {
+	io.WriteString(writer, "# Variables\n")
+
+	for _, v := range x.sortedVariables() {
+		fmt.Fprintf(writer, "%s = ", v.Name)
+
+		for _, part := range v.Parts {
+			if part.IsVariable {
+				fmt.Fprintf(writer, "${%s}", part.Value)
+			} else {
+				io.WriteString(writer, ninjaEscape(part.Value))
+			}
+		}
+
+		io.WriteString(writer, "\n")
+	}
+
+	fmt.Fprintf(writer, "version = %s\n", x.versionString())
+	fmt.Fprintf(writer, "target = %s\n", ninjaEscape(x.TargetName()))
+	io.WriteString(writer, "installdir = ${bindir}\n")
+	io.WriteString(writer, "destdir =\n\n")
+
+	io.WriteString(writer, "# Rules\n")
+	io.WriteString(writer, "rule go_build\n")
+
+	io.WriteString(writer, "  command = go build -o $out\n")
+	io.WriteString(writer, "  description = GO $out\n\n")
+
+	io.WriteString(writer, "rule install\n")
+	io.WriteString(writer, "  command = mkdir -p ${destdir}${installdir} && cp $in ${destdir}${installdir}/${target}\n")
+	io.WriteString(writer, "  description = INSTALL $in\n\n")
+
+	io.WriteString(writer, "rule uninstall\n")
+	io.WriteString(writer, "  command = rm -f ${destdir}${installdir}/${target}\n")
+	io.WriteString(writer, "  description = UNINSTALL ${target}\n\n")
+
+	// go build does its own dependency tracking, so always invoke it
+	io.WriteString(writer, "build always: phony\n")
+	io.WriteString(writer, "build ${target}: go_build | always\n")
+	io.WriteString(writer, "build install: install ${target}\n")
+	io.WriteString(writer, "build uninstall: uninstall\n\n")
+
+	io.WriteString(writer, "default ${target}\n")
+}
+
+func cmakeQuote(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "$", "\\$").Replace(s) + "\""
+}
+
+// WriteCMake writes a cmake file for the given parser to the given writer.
+// The cmake file sets a cache entry for each option, named after the upper
+// cased long name of the option, with the expanded value as its default and
+// the option description as its documentation. The application version is
+// set in the VERSION variable.
+func (x *Config) WriteCMake(writer io.Writer) {
+	for _, name := range x.optionNames() {
+		option := x.valuesMap[name]
+
+		var value string
+		typ := "STRING"
+
+		if _, ok := x.expanded[name]; ok {
+			value = x.Expand(name)
+		} else if b, ok := option.Value().(bool); ok {
+			typ = "BOOL"
+
+			if b {
+				value = "ON"
+			} else {
+				value = "OFF"
+			}
+		} else {
+			value = fmt.Sprintf("%v", x.expandValue(reflect.ValueOf(option.Value())).Interface())
+		}
+
+		fmt.Fprintf(writer, "set(%s %s CACHE %s %s)\n",
+			strings.ToUpper(name),
+			cmakeQuote(value),
+			typ,
+			cmakeQuote(option.Description))
+	}
+
+	fmt.Fprintf(writer, "set(VERSION %s)\n", cmakeQuote(x.versionString()))
+}
+
+// rpmDirs maps the standard directory options to their rpm macros.
+var rpmDirs = []struct {
+	Name  string
+	Macro string
+}{
+	{"prefix", "%{_prefix}"},
+	{"execprefix", "%{_exec_prefix}"},
+	{"bindir", "%{_bindir}"},
+	{"libexecdir", "%{_libexecdir}"},
+	{"sysconfdir", "%{_sysconfdir}"},
+	{"libdir", "%{_libdir}"},
+	{"datarootdir", "%{_datarootdir}"},
+	{"datadir", "%{_datadir}"},
+	{"mandir", "%{_mandir}"},
+}
+
+// WriteRPMSpec writes an rpm spec file skeleton for the given parser to the
+// given writer. The spec file builds and installs the target using the
+// generated Makefile, passing the rpm directory macros for the configured
+// directories.
+func (x *Config) WriteRPMSpec(writer io.Writer) {
+	target := x.TargetName()
+
+	fmt.Fprintf(writer, "Name:           %s\n", target)
+	fmt.Fprintf(writer, "Version:        %s\n", strings.Replace(x.versionString(), "-", "~", -1))
+	io.WriteString(writer, "Release:        1%{?dist}\n")
+	fmt.Fprintf(writer, "Summary:        %s\n\n", target)
+
+	io.WriteString(writer, "License:        FIXME\n")
+	io.WriteString(writer, "Source0:        %{name}-%{version}.tar.gz\n\n")
+	io.WriteString(writer, "BuildRequires:  golang\n\n")
+
+	io.WriteString(writer, "%description\n")
+	fmt.Fprintf(writer, "%s\n\n", target)
+
+	io.WriteString(writer, "%prep\n")
+	io.WriteString(writer, "%autosetup\n\n")
+
+	io.WriteString(writer, "%build\n")
+	io.WriteString(writer, "make %{?_smp_mflags}\n\n")
+
+	io.WriteString(writer, "%install\n")
+	io.WriteString(writer, "make install DESTDIR=%{buildroot}")
+
+	for _, dir := range rpmDirs {
+		if _, ok := x.expanded[dir.Name]; ok {
+			fmt.Fprintf(writer, " %s=%s", dir.Name, dir.Macro)
+		}
+	}
+
+	io.WriteString(writer, "\n\n")
+
+	io.WriteString(writer, "%files\n")
+	fmt.Fprintf(writer, "%%{_bindir}/%s\n", target)
+
+	if _, ok := x.expanded["mandir"]; ok {
+		fmt.Fprintf(writer, "#%%{_mandir}/man1/%s.1*\n", target)
+	}
+
+	if _, ok := x.expanded["datadir"]; ok {
+		fmt.Fprintf(writer, "#%%{_datadir}/%s/\n", target)
+	}
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "'\\''", -1) + "'"
+}
+
+// shellName returns the upper cased shell variable name for a long option name.
+func shellName(name string) string {
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// WriteShellExports writes a shell script exporting all the variable values
+// to the given writer, see WriteShell.
+func (x *Config) WriteShellExports(writer io.Writer) {
+	x.WriteShell(writer)
+}
+
+// WriteShell writes a shell script exporting all the variable values to the
+// given writer. The script can be sourced by a shell. Variable names are upper
+// cased, and the application version is exported as VERSION.
+func (x *Config) WriteShell(writer io.Writer) {
+	for _, name := range x.optionNames() {
+		var value string
+
+		if _, ok := x.expanded[name]; ok {
+			value = x.Expand(name)
+		} else {
+			value = makefileValue(x.expandValue(reflect.ValueOf(x.valuesMap[name].Value())))
+		}
+
+		fmt.Fprintf(writer, "export %s=%s\n", shellName(name), shellQuote(value))
+	}
+
+	fmt.Fprintf(writer, "export VERSION=%s\n", shellQuote(x.versionString()))
+}
+
+func markdownEscape(s string) string {
+	return strings.Replace(s, "|", "\\|", -1)
+}
+
+// WriteMarkdownConfig writes a markdown table documenting all the options to
+// the given writer, listing the flags, default value, description and resolved
+// value of each option.
+func (x *Config) WriteMarkdownConfig(writer io.Writer) {
+	io.WriteString(writer, "| Option | Default | Description | Value |\n")
+	io.WriteString(writer, "| --- | --- | --- | --- |\n")
+
+	for _, name := range x.optionNames() {
+		option := x.valuesMap[name]
+
+		var def, value string
+
+		if _, ok := x.expanded[name]; ok {
+			def = x.defaults[name]
+			value = x.Expand(name)
+		} else {
+			def = strings.Join(option.Default, " ")
+			value = makefileValue(x.expandValue(reflect.ValueOf(option.Value())))
+		}
+
+		fmt.Fprintf(writer, "| `%s` | %s | %s | %s |\n",
+			flagNames(option),
+			markdownEscape(def),
+			markdownEscape(option.Description),
+			markdownEscape(value))
+	}
 }
@@ -0,0 +1,3167 @@
+package configure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"go/format"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseArgs(data interface{}, args ...string) (*Config, error) {
+	if data == nil {
+		data = NewOptions()
+	}
+
+	parser := flags.NewParser(data, flags.IgnoreUnknown)
+	defaults := optionDefaults(parser)
+
+	if _, err := parser.ParseArgs(args); err != nil {
+		return nil, err
+	}
+
+	return newConfig(parser, nil, defaults)
+}
+
+func parseConfig(t *testing.T, data interface{}, args ...string) *Config {
+	c, err := parseArgs(data, args...)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	return c
+}
+
+func goConfig(c *Config) string {
+	var buf bytes.Buffer
+
+	c.WriteGoConfig(&buf)
+	return buf.String()
+}
+
+func makefile(c *Config) string {
+	return c.MakefileString()
+}
+
+func TestPrefixOnly(t *testing.T) {
+	c := parseConfig(t, nil, "--prefix=/opt/app")
+
+	if v := c.Expand("bindir"); v != "/opt/app/bin" {
+		t.Errorf("Expected bindir to be /opt/app/bin, but got %s", v)
+	}
+
+	if v := c.Expand("mandir"); v != "/opt/app/share/man" {
+		t.Errorf("Expected mandir to be /opt/app/share/man, but got %s", v)
+	}
+
+	if s := goConfig(c); !strings.Contains(s, "\t\"/opt/app/bin\",\n") {
+		t.Errorf("Expected go config to contain bindir /opt/app/bin:\n%s", s)
+	}
+}
+
+func TestInstallDir(t *testing.T) {
+	c := parseConfig(t, nil)
+
+	if v := c.InstallDir("bin"); v != c.Expand("bindir") {
+		t.Errorf("Expected bin install dir %s, but got %s", c.Expand("bindir"), v)
+	}
+
+	if v := c.InstallDir("man"); v != "/usr/local/share/man" {
+		t.Errorf("Expected man install dir /usr/local/share/man, but got %s", v)
+	}
+
+	if v := c.InstallDir("nonexisting"); v != "" {
+		t.Errorf("Expected empty install dir for unknown kind, but got %s", v)
+	}
+}
+
+func TestGoConfigBuildTags(t *testing.T) {
+	GoConfigBuildTags = []string{"configured", "linux"}
+	defer func() { GoConfigBuildTags = nil }()
+
+	s := goConfig(parseConfig(t, nil))
+
+	expected := "// Code generated by go-configure; DO NOT EDIT.\n\n//go:build configured && linux\n// +build configured,linux\n\npackage main\n\n"
+
+	if !strings.HasPrefix(s, expected) {
+		t.Errorf("Expected go config to start with build constraints:\n%s", s)
+	}
+
+	if formatted, err := format.Source([]byte(s)); err != nil {
+		t.Errorf("Unexpected error formatting go config: %s", err)
+	} else if !strings.HasPrefix(string(formatted), expected) {
+		t.Errorf("Expected build constraints to be gofmt clean:\n%s", formatted)
+	}
+}
+
+func TestFormatGoConfig(t *testing.T) {
+	b, err := parseConfig(t, nil).formatGoConfig(Package)
+
+	if err != nil {
+		t.Fatalf("Unexpected error formatting go config: %s", err)
+	}
+
+	if formatted, _ := format.Source(b); !bytes.Equal(formatted, b) {
+		t.Errorf("Expected formatted go config to be gofmt clean:\n%s", b)
+	}
+}
+
+func TestFormatGoConfigInvalid(t *testing.T) {
+	Package = "not valid"
+	defer func() { Package = "main" }()
+
+	if _, err := parseConfig(t, nil).formatGoConfig(Package); err == nil {
+		t.Errorf("Expected error formatting go config with invalid package name")
+	}
+}
+
+func runGoConfig(t *testing.T, c *Config, main string) string {
+	gobin, err := exec.LookPath("go")
+
+	if err != nil {
+		t.Skip("go tool not available")
+	}
+
+	dir := t.TempDir()
+	b, err := c.formatGoConfig(Package)
+
+	if err != nil {
+		t.Fatalf("Unexpected error formatting go config: %s", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "appconfig.go"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(main), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(gobin, "run", "appconfig.go", "main.go")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=", "GO111MODULE=off")
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Unexpected error running go config: %s\n%s", err, out)
+	}
+
+	return string(out)
+}
+
+func TestGoConfigBuildInfo(t *testing.T) {
+	GoConfigBuildInfo = true
+	defer func() { GoConfigBuildInfo = false }()
+
+	c := parseConfig(t, nil)
+
+	out := runGoConfig(t, c, "package main\n\nfunc main() {\n\tprint(AppConfigVersion())\n}\n")
+
+	if out != "0.1" {
+		t.Errorf("Expected fallback version 0.1, but got %s", out)
+	}
+}
+
+func runMake(t *testing.T, c *Config, dir string, args ...string) string {
+	makebin, err := exec.LookPath("make")
+
+	if err != nil {
+		t.Skip("make not available")
+	}
+
+	if len(dir) == 0 {
+		dir = t.TempDir()
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "go.make"), []byte(makefile(c)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(makebin, append([]string{"-s", "-f", "go.make"}, args...)...)
+	cmd.Dir = dir
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Unexpected error running make %v: %s\n%s", args, err, out)
+	}
+
+	return string(out)
+}
+
+func TestMakefileHelp(t *testing.T) {
+	Target = "example"
+	defer func() { Target = "" }()
+
+	out := runMake(t, parseConfig(t, nil), "", "help")
+
+	if !strings.Contains(out, "  clean                Remove the built executable\n") {
+		t.Errorf("Expected help to describe the clean target:\n%s", out)
+	}
+
+	if !strings.Contains(out, "  example              Build the executable\n") {
+		t.Errorf("Expected help to describe the executable target:\n%s", out)
+	}
+}
+
+type sliceOptions struct {
+	Options
+
+	Paths []string `long:"paths" description:"search paths"`
+	Ports []int    `long:"ports" description:"ports"`
+}
+
+func TestGoConfigSliceExpansion(t *testing.T) {
+	opts := &sliceOptions{Options: *NewOptions()}
+	c := parseConfig(t, opts, "--paths=${prefix}/a", "--paths=${datadir}/b", "--ports=80", "--ports=443")
+
+	s := goConfig(c)
+
+	if !strings.Contains(s, "\t[]string{\"/usr/local/a\", \"/usr/local/share/b\"},\n") {
+		t.Errorf("Expected expanded string slice in go config:\n%s", s)
+	}
+
+	if !strings.Contains(s, "\t[]int{80, 443},\n") {
+		t.Errorf("Expected int slice in go config:\n%s", s)
+	}
+}
+
+type convertOptions struct {
+	Options
+
+	DefaultPort string `long:"defaultport" description:"default port"`
+	Port        string `long:"port" description:"port" configure:"int"`
+}
+
+func TestGoConfigConversion(t *testing.T) {
+	opts := &convertOptions{Options: *NewOptions(), DefaultPort: "8080"}
+	c := parseConfig(t, opts, "--port=${defaultport}")
+
+	if err := c.checkVariables(); err != nil {
+		t.Fatalf("Unexpected error checking variables: %s", err)
+	}
+
+	s := goConfig(c)
+
+	if !strings.Contains(s, "\tPort int\n") || !strings.Contains(s, "\t8080,\n") {
+		t.Errorf("Expected port to be converted to int in go config:\n%s", s)
+	}
+
+	if !strings.Contains(s, "\tDefaultport string\n") || !strings.Contains(s, "\t\"8080\",\n") {
+		t.Errorf("Expected untagged default port to remain a string in go config:\n%s", s)
+	}
+
+	if m := makefile(c); !strings.Contains(m, "port ?= $(defaultport)\n") {
+		t.Errorf("Expected unconverted port in makefile:\n%s", m)
+	}
+
+	GoConfigExpand = false
+	defer func() { GoConfigExpand = true }()
+
+	if s := goConfig(c); !strings.Contains(s, "\tPort string\n") {
+		t.Errorf("Expected unexpanded port to remain a string in go config:\n%s", s)
+	}
+}
+
+func TestGoConfigConversionError(t *testing.T) {
+	opts := &convertOptions{Options: *NewOptions()}
+	c := parseConfig(t, opts, "--port=http")
+
+	if err := c.checkVariables(); err == nil || !strings.Contains(err.Error(), "--port") {
+		t.Errorf("Expected error for invalid port, but got %v", err)
+	}
+
+	conversions := GoConfigConversions
+	GoConfigConversions = map[string]func(string) (interface{}, error){}
+	defer func() { GoConfigConversions = conversions }()
+
+	c = parseConfig(t, opts, "--port=80")
+
+	if err := c.checkVariables(); err == nil || !strings.Contains(err.Error(), "unknown conversion int") {
+		t.Errorf("Expected error for unknown conversion, but got %v", err)
+	}
+}
+
+type mapOptions struct {
+	Options
+
+	Paths map[string]string `long:"paths" description:"named paths"`
+	Empty map[string]string `long:"empty" description:"empty map"`
+}
+
+func TestGoConfigMapExpansion(t *testing.T) {
+	opts := &mapOptions{Options: *NewOptions(), Empty: map[string]string{}}
+	c := parseConfig(t, opts, "--paths=doc:${datadir}/doc", "--paths=${prefix}:root")
+
+	s := goConfig(c)
+
+	if !strings.Contains(s, "\tmap[string]string{\"/usr/local\":\"root\", \"doc\":\"/usr/local/share/doc\"},\n") {
+		t.Errorf("Expected expanded map in go config:\n%s", s)
+	}
+
+	if !strings.Contains(s, "\tmap[string]string{},\n") {
+		t.Errorf("Expected empty map in go config:\n%s", s)
+	}
+
+	if _, err := c.formatGoConfig(Package); err != nil {
+		t.Errorf("Unexpected error formatting go config: %s", err)
+	}
+}
+
+type upperExpander struct{}
+
+func (upperExpander) Expand(value string, variables map[string]string) (string, []string) {
+	var deps []string
+
+	r := regexp.MustCompile(`\$\{([^}]*)\}`)
+
+	ret := r.ReplaceAllStringFunc(value, func(s string) string {
+		name := s[2 : len(s)-1]
+		deps = append(deps, name)
+
+		return strings.ToUpper(name)
+	})
+
+	return ret, deps
+}
+
+func TestCustomExpander(t *testing.T) {
+	ValueExpander = upperExpander{}
+	defer func() { ValueExpander = nil }()
+
+	opts := &sliceOptions{Options: *NewOptions()}
+	c := parseConfig(t, opts, "--paths=${prefix}/a")
+
+	if v := c.Expand("bindir"); v != "EXECPREFIX/bin" {
+		t.Errorf("Expected bindir to be EXECPREFIX/bin, but got %s", v)
+	}
+
+	if s := goConfig(c); !strings.Contains(s, "\t[]string{\"PREFIX/a\"},\n") {
+		t.Errorf("Expected custom expansion of slice elements:\n%s", s)
+	}
+
+	if s := makefile(c); !strings.Contains(s, "bindir ?= EXECPREFIX/bin\n") {
+		t.Errorf("Expected expanded bindir in makefile:\n%s", s)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	b, err := json.Marshal(parseConfig(t, nil, "--prefix=/opt/app"))
+
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling config: %s", err)
+	}
+
+	var ret struct {
+		BinDir  string `json:"bindir"`
+		Version []int  `json:"version"`
+	}
+
+	if err := json.Unmarshal(b, &ret); err != nil {
+		t.Fatalf("Unexpected error unmarshaling config: %s", err)
+	}
+
+	if ret.BinDir != "/opt/app/bin" {
+		t.Errorf("Expected bindir to be /opt/app/bin, but got %s", ret.BinDir)
+	}
+
+	if len(ret.Version) != 2 || ret.Version[0] != 0 || ret.Version[1] != 1 {
+		t.Errorf("Expected version [0 1], but got %v", ret.Version)
+	}
+}
+
+func configure(t *testing.T, data interface{}, args ...string) (*Config, error) {
+	oldArgs := os.Args
+	oldTarget := Target
+	oldOutputDir := OutputDir
+
+	os.Args = append([]string{"configure"}, args...)
+	Target = "example"
+
+	if OutputDir == "." {
+		OutputDir = t.TempDir()
+	}
+
+	defer func() {
+		os.Args = oldArgs
+		Target = oldTarget
+		OutputDir = oldOutputDir
+	}()
+
+	return Configure(data)
+}
+
+func TestNewConfig(t *testing.T) {
+	oldArgs := os.Args
+	OutputDir = t.TempDir()
+
+	defer func() {
+		os.Args = oldArgs
+		OutputDir = "."
+	}()
+
+	os.Args = []string{"configure", "--prefix=/opt/app"}
+
+	c, err := NewConfig(nil)
+
+	if err != nil {
+		t.Fatalf("Unexpected error creating config: %s", err)
+	}
+
+	if v := c.Expand("bindir"); v != "/opt/app/bin" {
+		t.Errorf("Expected bindir to be /opt/app/bin, but got %s", v)
+	}
+
+	if s := makefile(c); !strings.Contains(s, "prefix ?= /opt/app\n") {
+		t.Errorf("Expected prefix in makefile:\n%s", s)
+	}
+
+	if entries, _ := os.ReadDir(OutputDir); len(entries) != 0 {
+		t.Errorf("Expected no files to be written, but got %v", entries)
+	}
+
+	if err := c.GenerateGoConfig(); err != nil {
+		t.Fatalf("Unexpected error generating go config: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(OutputDir, "appconfig.go")); err != nil {
+		t.Errorf("Expected go config to be generated: %s", err)
+	}
+}
+
+func TestConfigureFromJSON(t *testing.T) {
+	defer func() {
+		features = nil
+		packages = nil
+	}()
+
+	oldArgs := os.Args
+	OutputDir = t.TempDir()
+	Target = "example"
+
+	defer func() {
+		os.Args = oldArgs
+		OutputDir = "."
+		Target = ""
+	}()
+
+	// The command line is not used
+	os.Args = []string{"configure", "--prefix=/ignored"}
+
+	ssl := Feature("ssl", "use ssl", true)
+	zlib := WithPackage("zlib", "use zlib from the given prefix", "no")
+	tls := WithPackage("tls", "use tls from the given prefix", "yes")
+	opts := &sliceOptions{Options: *NewOptions()}
+
+	r := strings.NewReader(`{
+		"prefix": "/opt/app",
+		"BinDir": "${prefix}/tools",
+		"paths": ["${datadir}/a", "-b"],
+		"ports": [80, 443],
+		"enable-ssl": false,
+		"with-zlib": "/usr",
+		"with-tls": false,
+		"version-suffix": "-dev"
+	}`)
+
+	c, err := ConfigureFromJSON(opts, r)
+
+	if err != nil {
+		t.Fatalf("Unexpected error configuring from json: %s", err)
+	}
+
+	if v := c.Expand("bindir"); v != "/opt/app/tools" {
+		t.Errorf("Expected bindir to be /opt/app/tools, but got %s", v)
+	}
+
+	if *ssl {
+		t.Errorf("Expected ssl feature to be disabled")
+	}
+
+	if *zlib != "/usr" {
+		t.Errorf("Expected with-zlib to be /usr, but got %s", *zlib)
+	}
+
+	if *tls != "no" {
+		t.Errorf("Expected with-tls to be no, but got %s", *tls)
+	}
+
+	b, err := os.ReadFile(filepath.Join(OutputDir, "go.make"))
+
+	if err != nil {
+		t.Fatalf("Expected makefile to be generated: %s", err)
+	}
+
+	if s := string(b); !strings.Contains(s, "prefix ?= /opt/app\n") || !strings.Contains(s, "bindir ?= $(prefix)/tools\n") || !strings.Contains(s, "ports ?= 80 443\n") || !strings.Contains(s, "version ?= 0.1-dev\n") {
+		t.Errorf("Expected json values in makefile:\n%s", s)
+	}
+
+	b, err = os.ReadFile(filepath.Join(OutputDir, "appconfig.go"))
+
+	if err != nil {
+		t.Fatalf("Expected go config to be generated: %s", err)
+	}
+
+	if s := string(b); !strings.Contains(s, "[]string{\"/opt/app/share/a\", \"-b\"}") || !strings.Contains(s, "[]int{80, 443}") {
+		t.Errorf("Expected json values in go config:\n%s", s)
+	}
+
+	if _, err := ConfigureFromJSON(nil, strings.NewReader(`{"unknown": "x"}`)); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("Expected error for unknown option, but got %v", err)
+	}
+
+	if _, err := ConfigureFromJSON(nil, strings.NewReader(`{`)); err == nil {
+		t.Errorf("Expected error for invalid json")
+	}
+}
+
+func TestOutputDir(t *testing.T) {
+	OutputDir = filepath.Join(t.TempDir(), "build")
+	defer func() { OutputDir = "." }()
+
+	if _, err := configure(t, nil); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	for _, name := range []string{"appconfig.go", "go.make", "Makefile"} {
+		if _, err := os.Stat(filepath.Join(OutputDir, name)); err != nil {
+			t.Errorf("Expected %s to be written to the output directory: %s", name, err)
+		}
+	}
+}
+
+func TestWriteGitignore(t *testing.T) {
+	OutputDir = t.TempDir()
+	WriteGitignore = true
+
+	defer func() {
+		OutputDir = "."
+		WriteGitignore = false
+	}()
+
+	filename := filepath.Join(OutputDir, ".gitignore")
+
+	if err := os.WriteFile(filename, []byte("bin/\nappconfig.go"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := configure(t, nil); err != nil {
+			t.Fatalf("Unexpected error configuring: %s", err)
+		}
+
+		b, err := os.ReadFile(filename)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != "bin/\nappconfig.go\nMakefile\ngo.make\n" {
+			t.Errorf("Expected generated files to be ignored once, but got:\n%s", b)
+		}
+	}
+
+	OutputDir = t.TempDir()
+	filename = filepath.Join(OutputDir, ".gitignore")
+
+	if err := os.WriteFile(filepath.Join(OutputDir, "Makefile"), []byte("all:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := configure(t, nil); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if b, _ := os.ReadFile(filename); string(b) != "appconfig.go\ngo.make\n" {
+		t.Errorf("Expected existing wrapper not to be ignored, but got:\n%s", b)
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	c := parseConfig(t, nil)
+
+	deps := c.Dependencies("mandir")
+
+	if strings.Join(deps, " ") != "datarootdir prefix" {
+		t.Errorf("Expected mandir to depend on datarootdir and prefix, but got %v", deps)
+	}
+
+	deps = c.Dependencies("bindir")
+
+	if strings.Join(deps, " ") != "execprefix prefix" {
+		t.Errorf("Expected bindir to depend on execprefix and prefix, but got %v", deps)
+	}
+
+	deps[0] = "modified"
+
+	if c.Dependencies("bindir")[0] != "execprefix" {
+		t.Errorf("Expected dependencies to return a copy")
+	}
+
+	if deps := c.Dependencies("prefix"); len(deps) != 0 {
+		t.Errorf("Expected prefix to have no dependencies, but got %v", deps)
+	}
+}
+
+func TestEmptyValue(t *testing.T) {
+	if v := parseConfig(t, nil, "--bindir=").Expand("bindir"); v != "/usr/local/bin" {
+		t.Errorf("Expected empty bindir to default to /usr/local/bin, but got %s", v)
+	}
+
+	EmptyValues = EmptyValueKeep
+	defer func() { EmptyValues = EmptyValueDefault }()
+
+	if v := parseConfig(t, nil, "--bindir=").Expand("bindir"); v != "" {
+		t.Errorf("Expected empty bindir to be kept, but got %s", v)
+	}
+
+	EmptyValues = EmptyValueError
+
+	if _, err := parseArgs(nil, "--bindir="); err == nil {
+		t.Errorf("Expected error for empty bindir")
+	}
+}
+
+func TestDockerTarget(t *testing.T) {
+	if s := makefile(parseConfig(t, nil)); strings.Contains(s, "docker") {
+		t.Errorf("Expected no docker target by default:\n%s", s)
+	}
+
+	DockerTarget = true
+	defer func() { DockerTarget = false }()
+
+	s := makefile(parseConfig(t, nil))
+
+	if !strings.Contains(s, "\t$(DOCKER) build -f $(DOCKERFILE) -t $(TARGET):$(version) --build-arg bindir=$(bindir) ") {
+		t.Errorf("Expected docker target tagged with target and version:\n%s", s)
+	}
+
+	if !strings.Contains(s, "DOCKER ?= $(shell command -v docker 2>/dev/null)\n") || !strings.Contains(s, "\t$(if $(DOCKER),,$(error ") {
+		t.Errorf("Expected docker target to be guarded on docker being available:\n%s", s)
+	}
+
+	if !strings.HasSuffix(s, ".PHONY: install uninstall distclean clean dist docs test check distcheck run docker help") {
+		t.Errorf("Expected docker target to be phony:\n%s", s)
+	}
+
+	makebin, err := exec.LookPath("make")
+
+	if err != nil {
+		t.Skip("make not available")
+	}
+
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "go.make"), []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(makebin, "-s", "-f", "go.make", "docker", "DOCKER=")
+	cmd.Dir = dir
+
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "docker is required") {
+		t.Errorf("Expected docker target to fail without docker, got %v:\n%s", err, out)
+	}
+}
+
+func TestWriteNinja(t *testing.T) {
+	Target = "example"
+	defer func() { Target = "" }()
+
+	var buf bytes.Buffer
+
+	parseConfig(t, nil).WriteNinja(&buf)
+	s := buf.String()
+
+	expected := []string{
+		"prefix = /usr/local\n",
+		"execprefix = ${prefix}\n",
+		"bindir = ${execprefix}/bin\n",
+		"version = 0.1\n",
+		"target = example\n",
+		"  command = go build -o $out\n",
+		"build ${target}: go_build | always\n",
+		"build install: install ${target}\n",
+	}
+
+	for _, e := range expected {
+		if !strings.Contains(s, e) {
+			t.Errorf("Expected ninja file to contain %q:\n%s", e, s)
+		}
+	}
+
+	if strings.Index(s, "execprefix =") > strings.Index(s, "bindir =") {
+		t.Errorf("Expected execprefix to be defined before bindir:\n%s", s)
+	}
+}
+
+func TestWriteCMake(t *testing.T) {
+	var buf bytes.Buffer
+
+	parseConfig(t, nil, "--prefix=/opt/my \"app\"").WriteCMake(&buf)
+	s := buf.String()
+
+	if !strings.Contains(s, "set(PREFIX \"/opt/my \\\"app\\\"\" CACHE STRING \"install architecture-independent files in PREFIX\")\n") {
+		t.Errorf("Expected cmake file to set PREFIX:\n%s", s)
+	}
+
+	if !strings.Contains(s, "set(BINDIR \"/opt/my \\\"app\\\"/bin\" CACHE STRING \"user executables\")\n") {
+		t.Errorf("Expected cmake file to set expanded BINDIR:\n%s", s)
+	}
+
+	if !strings.HasSuffix(s, "set(VERSION \"0.1\")\n") {
+		t.Errorf("Expected cmake file to set VERSION:\n%s", s)
+	}
+}
+
+func TestFilenameVariables(t *testing.T) {
+	opts := &sliceOptions{Options: *NewOptions()}
+	opts.DataDir = "${datarootdir}/${makefile}"
+
+	c := parseConfig(t, opts, "--paths=${goconfig}")
+
+	if v := c.Expand("datadir"); v != "/usr/local/share/go.make" {
+		t.Errorf("Expected datadir to be /usr/local/share/go.make, but got %s", v)
+	}
+
+	if s := goConfig(c); !strings.Contains(s, "\t[]string{\"appconfig.go\"},\n") {
+		t.Errorf("Expected goconfig reference to be expanded:\n%s", s)
+	}
+
+	s := makefile(c)
+
+	if !strings.Contains(s, "makefile ?= go.make\n") || !strings.Contains(s, "datadir ?= $(datarootdir)/$(makefile)\n") {
+		t.Errorf("Expected makefile variable in makefile:\n%s", s)
+	}
+}
+
+func TestVariablesConsistent(t *testing.T) {
+	for _, data := range []interface{}{NewOptions(), &sliceOptions{Options: *NewOptions()}, &mapOptions{Options: *NewOptions()}} {
+		c := parseConfig(t, data)
+
+		if err := c.checkVariables(); err != nil {
+			t.Errorf("Unexpected inconsistency: %s", err)
+		}
+
+		gonames := c.optionNames()
+		var makenames []string
+
+		for _, name := range c.makefileVariables() {
+			if _, ok := c.valuesMap[name]; ok {
+				makenames = append(makenames, name)
+			}
+		}
+
+		sort.Strings(makenames)
+
+		if strings.Join(gonames, " ") != strings.Join(makenames, " ") {
+			t.Errorf("Expected go config variables %v to equal makefile variables %v", gonames, makenames)
+		}
+	}
+}
+
+func TestMakefileNonStringValues(t *testing.T) {
+	opts := &sliceOptions{Options: *NewOptions()}
+	s := makefile(parseConfig(t, opts, "--paths=${prefix}/a", "--paths=b", "--ports=80", "--ports=443"))
+
+	if !strings.Contains(s, "paths ?= /usr/local/a b\n") {
+		t.Errorf("Expected paths in makefile:\n%s", s)
+	}
+
+	if !strings.Contains(s, "ports ?= 80 443\n") {
+		t.Errorf("Expected ports in makefile:\n%s", s)
+	}
+}
+
+func TestDefaultsFile(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"config.site": "# site defaults\nprefix = /opt/site\nmandir = /opt/man\n",
+		"config.json": `{"prefix": "/opt/site", "mandir": "/opt/man"}`,
+	}
+
+	defer func() { DefaultsFile = "" }()
+
+	for name, contents := range files {
+		DefaultsFile = filepath.Join(dir, name)
+
+		if err := os.WriteFile(DefaultsFile, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := configure(t, nil, "--mandir=/usr/man")
+
+		if err != nil {
+			t.Fatalf("Unexpected error configuring: %s", err)
+		}
+
+		if v := c.Expand("bindir"); v != "/opt/site/bin" {
+			t.Errorf("%s: expected defaults file to override built-in prefix, but got bindir %s", name, v)
+		}
+
+		if v := c.Expand("mandir"); v != "/usr/man" {
+			t.Errorf("%s: expected command line to override defaults file, but got mandir %s", name, v)
+		}
+	}
+
+	DefaultsFile = filepath.Join(dir, "nonexisting")
+
+	if _, err := configure(t, nil); err != nil {
+		t.Errorf("Unexpected error for missing defaults file: %s", err)
+	}
+}
+
+func TestVersionSuffix(t *testing.T) {
+	Version = []int{1, 2, 0}
+	VersionSuffix = "-rc1+build5"
+
+	defer func() {
+		Version = []int{0, 1}
+		VersionSuffix = ""
+	}()
+
+	c := parseConfig(t, nil)
+
+	if s := makefile(c); !strings.Contains(s, "version ?= 1.2.0-rc1+build5\n") {
+		t.Errorf("Expected version suffix in makefile:\n%s", s)
+	}
+
+	s := goConfig(c)
+
+	if !strings.Contains(s, "\t[]int{1, 2, 0},\n\t\"1.2.0-rc1+build5\",\n") {
+		t.Errorf("Expected version and version string in go config:\n%s", s)
+	}
+}
+
+func TestVersionString(t *testing.T) {
+	Version = []int{1, 2}
+	defer func() { Version = []int{0, 1} }()
+
+	s := goConfig(parseConfig(t, nil))
+
+	if !strings.Contains(s, "\tVersion []int\n") || !strings.Contains(s, "\tVersionString string\n") {
+		t.Errorf("Expected Version and VersionString fields in go config:\n%s", s)
+	}
+
+	if !strings.Contains(s, "\t[]int{1, 2},\n\t\"1.2\",\n") {
+		t.Errorf("Expected VersionString to match Version in go config:\n%s", s)
+	}
+}
+
+func TestVersionSuffixOption(t *testing.T) {
+	Version = []int{1, 2, 0}
+	VersionSuffix = "-rc1"
+
+	defer func() {
+		Version = []int{0, 1}
+		VersionSuffix = ""
+	}()
+
+	c, err := configure(t, nil, "--version-suffix=-dev")
+
+	if err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if s := makefile(c); !strings.Contains(s, "version ?= 1.2.0-rc1-dev\n") {
+		t.Errorf("Expected version suffix option in makefile:\n%s", s)
+	}
+
+	if s := goConfig(c); !strings.Contains(s, "\t[]int{1, 2, 0},\n\t\"1.2.0-rc1-dev\",\n") {
+		t.Errorf("Expected version suffix option in go config:\n%s", s)
+	}
+
+	if len(Version) != 3 || Version[2] != 0 {
+		t.Errorf("Expected version to be unchanged, but got %v", Version)
+	}
+
+	if VersionSuffix != "-rc1" {
+		t.Errorf("Expected VersionSuffix to be unchanged, but got %s", VersionSuffix)
+	}
+
+	// Configuring again does not append the suffix twice
+	c, err = configure(t, nil, "--version-suffix=-dev")
+
+	if err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if s := makefile(c); !strings.Contains(s, "version ?= 1.2.0-rc1-dev\n") {
+		t.Errorf("Expected version suffix option once in makefile:\n%s", s)
+	}
+}
+
+func TestVersionSeparatorPadding(t *testing.T) {
+	Version = []int{1, 4, 0}
+	VersionSeparator = "_"
+	VersionPadding = 2
+
+	defer func() {
+		Version = []int{0, 1}
+		VersionSeparator = "."
+		VersionPadding = 0
+	}()
+
+	c := parseConfig(t, nil)
+
+	if s := makefile(c); !strings.Contains(s, "version ?= 01_04_00\n") || !strings.Contains(s, "minor_version = 4\n") {
+		t.Errorf("Expected padded version in makefile:\n%s", s)
+	}
+
+	if s := goConfig(c); !strings.Contains(s, "\t[]int{1, 4, 0},\n\t\"01_04_00\",\n") {
+		t.Errorf("Expected padded version string in go config:\n%s", s)
+	}
+}
+
+func TestWrapperOnly(t *testing.T) {
+	WrapperOnly = true
+	OutputDir = t.TempDir()
+
+	defer func() {
+		WrapperOnly = false
+		OutputDir = "."
+	}()
+
+	if _, err := configure(t, nil); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(OutputDir, "Makefile"))
+
+	if err != nil {
+		t.Fatalf("Expected wrapper Makefile to be created: %s", err)
+	} else if string(b) != "include go.make\n" {
+		t.Errorf("Expected wrapper Makefile to include go.make, but got %s", b)
+	}
+
+	for _, name := range []string{"appconfig.go", "go.make"} {
+		if _, err := os.Stat(filepath.Join(OutputDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s not to be created", name)
+		}
+	}
+}
+
+func TestWrapperMakefile(t *testing.T) {
+	OutputDir = t.TempDir()
+	WrapperMakefile = "GNUmakefile"
+
+	defer func() {
+		OutputDir = "."
+		WrapperMakefile = "Makefile"
+	}()
+
+	if _, err := configure(t, nil); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if b, err := os.ReadFile(filepath.Join(OutputDir, "GNUmakefile")); err != nil {
+		t.Errorf("Expected wrapper GNUmakefile to be created: %s", err)
+	} else if string(b) != "include go.make\n" {
+		t.Errorf("Expected wrapper GNUmakefile to include go.make, but got %s", b)
+	}
+
+	if _, err := os.Stat(filepath.Join(OutputDir, "Makefile")); !os.IsNotExist(err) {
+		t.Errorf("Expected no Makefile to be created")
+	}
+}
+
+func TestNoWrapperMakefile(t *testing.T) {
+	OutputDir = t.TempDir()
+	WrapperMakefile = ""
+
+	defer func() {
+		OutputDir = "."
+		WrapperMakefile = "Makefile"
+	}()
+
+	if _, err := configure(t, nil); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(OutputDir, "Makefile")); !os.IsNotExist(err) {
+		t.Errorf("Expected no wrapper Makefile to be created")
+	}
+
+	if _, err := os.Stat(filepath.Join(OutputDir, "go.make")); err != nil {
+		t.Errorf("Expected go.make to be created: %s", err)
+	}
+
+	if v := strings.Join(EnabledOutputs(), " "); v != "goconfig makefile" {
+		t.Errorf("Expected outputs goconfig makefile, but got %s", v)
+	}
+}
+
+func TestTargetFromEnvironment(t *testing.T) {
+	if v := targetName(); v == "" || v == "fromenv" {
+		t.Fatalf("Expected target to be detected, but got %q", v)
+	}
+
+	t.Setenv("CONFIGURE_TARGET", "fromenv")
+
+	if v := targetName(); v != "fromenv" {
+		t.Errorf("Expected target from CONFIGURE_TARGET, but got %q", v)
+	}
+
+	Target = "explicit"
+	defer func() { Target = "" }()
+
+	if v := targetName(); v != "explicit" {
+		t.Errorf("Expected explicit target to take precedence, but got %q", v)
+	}
+}
+
+func TestWrapperMakefileError(t *testing.T) {
+	OutputDir = t.TempDir()
+	WrapperOnly = true
+	WrapperMakefile = filepath.Join("missing", "Makefile")
+
+	defer func() {
+		os.Chmod(OutputDir, 0755)
+		OutputDir = "."
+		WrapperOnly = false
+		WrapperMakefile = "Makefile"
+	}()
+
+	if _, err := configure(t, nil); err == nil {
+		t.Errorf("Expected error creating wrapper Makefile in missing directory")
+	}
+
+	WrapperMakefile = "Makefile"
+
+	if os.Getuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+
+	if err := os.Chmod(OutputDir, 0555); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := configure(t, nil); err == nil {
+		t.Errorf("Expected error creating wrapper Makefile in read-only directory")
+	}
+}
+
+func TestChanged(t *testing.T) {
+	OutputDir = t.TempDir()
+	defer func() { OutputDir = "." }()
+
+	if changed, err := parseConfig(t, nil).Changed(); err != nil || !changed {
+		t.Errorf("Expected missing files to be changed, but got %v (%v)", changed, err)
+	}
+
+	if _, err := configure(t, nil, "--prefix=/opt"); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	Target = "example"
+	defer func() { Target = "" }()
+
+	if changed, err := parseConfig(t, nil, "--prefix=/opt").Changed(); err != nil || changed {
+		t.Errorf("Expected identical configuration not to be changed, but got %v (%v)", changed, err)
+	}
+
+	if changed, err := parseConfig(t, nil, "--prefix=/usr").Changed(); err != nil || !changed {
+		t.Errorf("Expected different configuration to be changed, but got %v (%v)", changed, err)
+	}
+}
+
+func TestWriteMarkdownConfig(t *testing.T) {
+	var buf bytes.Buffer
+
+	parseConfig(t, nil, "--prefix=/opt").WriteMarkdownConfig(&buf)
+	s := buf.String()
+
+	if !strings.HasPrefix(s, "| Option | Default | Description | Value |\n| --- | --- | --- | --- |\n") {
+		t.Errorf("Expected markdown table header:\n%s", s)
+	}
+
+	if !strings.Contains(s, "| `--bindir` | ${execprefix}/bin | user executables | /opt/bin |\n") {
+		t.Errorf("Expected markdown table row for bindir:\n%s", s)
+	}
+}
+
+func TestBuildID(t *testing.T) {
+	a := parseConfig(t, nil, "--prefix=/opt")
+
+	if len(a.buildID) == 0 {
+		t.Fatalf("Expected a build ID to be generated")
+	}
+
+	if b := parseConfig(t, nil, "--prefix=/opt"); b.buildID != a.buildID {
+		t.Errorf("Expected the same build ID for the same inputs, but got %s and %s", a.buildID, b.buildID)
+	}
+
+	if b := parseConfig(t, nil, "--prefix=/usr"); b.buildID == a.buildID {
+		t.Errorf("Expected a different build ID for different inputs")
+	}
+
+	if s := makefile(a); !strings.Contains(s, "buildid ?= "+a.buildID+"\n") {
+		t.Errorf("Expected build ID in makefile:\n%s", s)
+	}
+
+	if s := goConfig(a); !strings.Contains(s, "\tBuildID string\n") || !strings.Contains(s, fmt.Sprintf("\t%q,\n}", a.buildID)) {
+		t.Errorf("Expected build ID in go config:\n%s", s)
+	}
+
+	BuildID = "custom"
+	defer func() { BuildID = "" }()
+
+	c := parseConfig(t, nil, "--bindir=${buildid}/bin")
+
+	if v := c.Expand("bindir"); v != "custom/bin" {
+		t.Errorf("Expected buildid variable to expand to custom, but got %s", v)
+	}
+}
+
+func TestUnchangedFilesNotRewritten(t *testing.T) {
+	OutputDir = t.TempDir()
+	defer func() { OutputDir = "." }()
+
+	if _, err := configure(t, nil); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	names := []string{"appconfig.go", "go.make"}
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	for _, name := range names {
+		if err := os.Chtimes(filepath.Join(OutputDir, name), past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := configure(t, nil); err != nil {
+		t.Fatalf("Unexpected error reconfiguring: %s", err)
+	}
+
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(OutputDir, name))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !info.ModTime().Equal(past) {
+			t.Errorf("Expected %s not to be rewritten", name)
+		}
+	}
+}
+
+func TestSetPrefix(t *testing.T) {
+	c := parseConfig(t, nil, "--mandir=/usr/man")
+
+	if err := c.SetPrefix("/opt"); err != nil {
+		t.Fatalf("Unexpected error setting prefix: %s", err)
+	}
+
+	expected := map[string]string{
+		"prefix":  "/opt",
+		"bindir":  "/opt/bin",
+		"datadir": "/opt/share",
+		"mandir":  "/usr/man",
+	}
+
+	for name, value := range expected {
+		if v := c.Expand(name); v != value {
+			t.Errorf("Expected %s to be %s, but got %s", name, value, v)
+		}
+	}
+
+	if s := goConfig(c); !strings.Contains(s, "\"/opt/bin\",") {
+		t.Errorf("Expected updated bindir in go config:\n%s", s)
+	}
+
+	if v, _ := c.Raw("prefix"); v != "/opt" {
+		t.Errorf("Expected prefix option to be /opt, but got %v", v)
+	}
+
+	if b := parseConfig(t, nil, "--mandir=/usr/man", "--prefix=/opt"); b.buildID != c.buildID {
+		t.Errorf("Expected the build ID to be generated again, but got %s and %s", c.buildID, b.buildID)
+	}
+
+	if a := parseConfig(t, nil, "--mandir=/usr/man"); a.buildID == c.buildID {
+		t.Errorf("Expected a different build ID after setting the prefix")
+	}
+
+	DefaultsFile = filepath.Join(t.TempDir(), "config.site")
+	defer func() { DefaultsFile = "" }()
+
+	if err := c.saveDefaults(); err != nil {
+		t.Fatalf("Unexpected error saving defaults: %s", err)
+	}
+
+	if b, _ := os.ReadFile(DefaultsFile); !strings.Contains(string(b), "prefix = /opt\n") {
+		t.Errorf("Expected new prefix in defaults file:\n%s", b)
+	}
+
+	if err := c.SetPrefix("/opt\nall:"); err == nil {
+		t.Errorf("Expected error setting prefix containing a newline")
+	}
+
+	if v := c.Expand("bindir"); v != "/opt/bin" {
+		t.Errorf("Expected bindir to be unchanged after an invalid prefix, but got %s", v)
+	}
+
+	if err := parseConfig(t, &pluginOptions{}).SetPrefix("/opt"); err == nil {
+		t.Errorf("Expected error setting prefix without prefix option")
+	}
+}
+
+func TestGoConfigRaw(t *testing.T) {
+	GoConfigExpand = false
+	defer func() { GoConfigExpand = true }()
+
+	s := goConfig(parseConfig(t, nil, "--prefix=/opt"))
+
+	if !strings.Contains(s, "\t\"${execprefix}/bin\",\n") {
+		t.Errorf("Expected raw bindir in go config:\n%s", s)
+	}
+
+	if !strings.Contains(s, "\t\"/opt\",\n") {
+		t.Errorf("Expected prefix in go config:\n%s", s)
+	}
+}
+
+func TestGoConfigRuntimeExpand(t *testing.T) {
+	GoConfigExpand = false
+	defer func() { GoConfigExpand = true }()
+
+	c := parseConfig(t, nil, "--prefix=/opt")
+	out := runGoConfig(t, c, "package main\n\nfunc main() {\n\tprint(AppConfigExpand(AppConfig.Bindir))\n}\n")
+
+	if out != "/opt/bin" {
+		t.Errorf("Expected bindir to expand to /opt/bin at runtime, but got %s", out)
+	}
+}
+
+func TestExpandDelimiters(t *testing.T) {
+	Target = "example"
+	ExpandOpen = "<<"
+	ExpandClose = ">>"
+
+	defer func() {
+		Target = ""
+		ExpandOpen = "${"
+		ExpandClose = "}"
+	}()
+
+	opts := &struct {
+		Options
+
+		Template string `long:"template" description:"template"`
+	}{Options: *NewOptions()}
+
+	c := parseConfig(t, opts, "--prefix=/opt", "--template=<<bindir>>/${name}")
+
+	if v := c.Expand("bindir"); v != "/opt/bin" {
+		t.Errorf("Expected bindir to be /opt/bin, but got %s", v)
+	}
+
+	if v := c.Expand("template"); v != "/opt/bin/${name}" {
+		t.Errorf("Expected template to be /opt/bin/${name}, but got %s", v)
+	}
+
+	s := makefile(c)
+
+	if !strings.Contains(s, "bindir ?= $(execprefix)/bin\n") || !strings.Contains(s, "template ?= $(bindir)/$${name}\n") {
+		t.Errorf("Expected make references in makefile:\n%s", s)
+	}
+
+	if out := runMake(t, c, "", "--eval=print: ; @echo '$(bindir)'", "print"); out != "/opt/bin\n" {
+		t.Errorf("Expected bindir /opt/bin, but got %s", out)
+	}
+
+	GoConfigExpand = false
+	defer func() { GoConfigExpand = true }()
+
+	out := runGoConfig(t, c, "package main\n\nfunc main() {\n\tprint(AppConfigExpand(AppConfig.Template))\n}\n")
+
+	if out != "/opt/bin/${name}" {
+		t.Errorf("Expected template to expand to /opt/bin/${name} at runtime, but got %s", out)
+	}
+}
+
+func TestMakefileDollar(t *testing.T) {
+	Target = "example"
+	ExpandOpen = "@{"
+
+	defer func() {
+		Target = ""
+		ExpandOpen = "${"
+	}()
+
+	c := parseConfig(t, nil, "--prefix=/opt", "--bindir=@{prefix}/bin/${NAME}", "--datadir=/opt/$$")
+
+	if v := c.Expand("bindir"); v != "/opt/bin/${NAME}" {
+		t.Errorf("Expected bindir to be /opt/bin/${NAME}, but got %s", v)
+	}
+
+	out := runMake(t, c, "", "--eval=print: ; @echo '$(bindir) $(datadir)'", "print")
+
+	if out != "/opt/bin/${NAME} /opt/$$\n" {
+		t.Errorf("Expected literal $ in make values, but got %s", out)
+	}
+}
+
+func TestGoConfigRuntimeExpandFieldName(t *testing.T) {
+	GoConfigExpand = false
+	defer func() { GoConfigExpand = true }()
+
+	c := parseConfig(t, nil, "--prefix=/opt", "--bindir=${Prefix}/bin", "--libdir=${ExecPrefix}/lib")
+
+	if s := goConfig(c); !strings.Contains(s, "\t\t\"Prefix\": AppConfig.Prefix,\n") {
+		t.Errorf("Expected field name aliases in runtime variables:\n%s", s)
+	}
+
+	out := runGoConfig(t, c, "package main\n\nfunc main() {\n\tprint(AppConfigExpand(AppConfig.Bindir), \" \", AppConfigExpand(AppConfig.Libdir))\n}\n")
+
+	if out != "/opt/bin /opt/lib" {
+		t.Errorf("Expected field name references to expand at runtime, but got %s", out)
+	}
+}
+
+func TestGoConfigRuntimeExpandUnexported(t *testing.T) {
+	GoConfigExpand = false
+	GoConfigVariable = "appConfig"
+
+	defer func() {
+		GoConfigExpand = true
+		GoConfigVariable = "AppConfig"
+	}()
+
+	c := parseConfig(t, nil, "--prefix=/opt")
+
+	if err := c.ValidateGoConfig(); err != nil {
+		t.Fatalf("Unexpected error validating go config: %s", err)
+	}
+
+	out := runGoConfig(t, c, "package main\n\nfunc main() {\n\tprint(appConfigExpand(appConfig.Bindir))\n}\n")
+
+	if out != "/opt/bin" {
+		t.Errorf("Expected bindir to expand to /opt/bin at runtime, but got %s", out)
+	}
+}
+
+func TestExpandFieldName(t *testing.T) {
+	c := parseConfig(t, nil, "--prefix=/opt", "--bindir=${Prefix}/bin", "--libdir=${prefix}/lib", "--mandir=${DataRootDir}/man")
+
+	expected := map[string]string{
+		"bindir": "/opt/bin",
+		"libdir": "/opt/lib",
+		"mandir": "/opt/share/man",
+	}
+
+	for name, value := range expected {
+		if v := c.Expand(name); v != value {
+			t.Errorf("Expected %s to be %s, but got %s", name, value, v)
+		}
+	}
+
+	if s := makefile(c); !strings.Contains(s, "bindir ?= $(prefix)/bin\n") {
+		t.Errorf("Expected field name reference to be written as long name reference:\n%s", s)
+	}
+
+	if _, ok := c.expanded["Prefix"]; ok {
+		t.Errorf("Expected field names not to be variables")
+	}
+}
+
+func TestMakefileUninstallDirectories(t *testing.T) {
+	Target = "example"
+	defer func() { Target = "" }()
+
+	c := parseConfig(t, nil)
+
+	if s := makefile(c); !strings.Contains(s, "\t@for dir in $(DESTDIR)$($(TARGET)_installdir) $(DESTDIR)$(datadir)/$(TARGET); do") {
+		t.Errorf("Expected uninstall to remove the per-target data directory:\n%s", s)
+	}
+
+	dir := t.TempDir()
+	destdir := filepath.Join(dir, "dest")
+	prefix := filepath.Join(destdir, "usr", "local")
+	datadir := filepath.Join(prefix, "share", "example")
+
+	if err := os.MkdirAll(datadir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	runMake(t, c, dir, "uninstall", "DESTDIR="+destdir, "UNINSTALL_RMDIR=no")
+
+	if _, err := os.Stat(datadir); err != nil {
+		t.Errorf("Expected data directory to be kept when disabled")
+	}
+
+	runMake(t, c, dir, "uninstall", "DESTDIR="+destdir)
+
+	if _, err := os.Stat(filepath.Join(prefix, "share")); !os.IsNotExist(err) {
+		t.Errorf("Expected empty data directories to be removed")
+	}
+
+	if _, err := os.Stat(prefix); err != nil {
+		t.Errorf("Expected prefix to be kept")
+	}
+}
+
+func TestMakefileComment(t *testing.T) {
+	Target = "example"
+	defer func() { Target = "" }()
+
+	c := parseConfig(t, nil, "--prefix=/opt/c#")
+
+	if s := makefile(c); !strings.Contains(s, "prefix ?= /opt/c\\#\n") {
+		t.Errorf("Expected # to be escaped in makefile:\n%s", s)
+	}
+
+	if out := runMake(t, c, "", "--eval=print: ; @echo '$(bindir)'", "print"); out != "/opt/c#/bin\n" {
+		t.Errorf("Expected bindir /opt/c#/bin, but got %s", out)
+	}
+}
+
+func TestMakefileDescriptions(t *testing.T) {
+	s := makefile(parseConfig(t, nil))
+
+	if !strings.Contains(s, "\n# install architecture-independent files in PREFIX\nprefix ?= /usr/local\n") {
+		t.Errorf("Expected prefix description in makefile:\n%s", s)
+	}
+
+	if !strings.Contains(s, "\n# Package options\nbuildid ?= ") {
+		t.Errorf("Expected no description for buildid in makefile:\n%s", s)
+	}
+}
+
+func TestMakefileConditional(t *testing.T) {
+	Target = "example"
+	defer func() { Target = "" }()
+
+	c := parseConfig(t, nil)
+
+	if s := makefile(c); !strings.Contains(s, "prefix ?= /usr/local\n") || !strings.Contains(s, "bindir ?= $(execprefix)/bin\n") {
+		t.Errorf("Expected conditional assignments in makefile:\n%s", s)
+	}
+
+	t.Setenv("prefix", "/env")
+
+	if out := runMake(t, c, "", "--eval=print: ; @echo '$(bindir)'", "print"); out != "/env/bin\n" {
+		t.Errorf("Expected bindir /env/bin from the environment, but got %s", out)
+	}
+
+	MakefileConditional = false
+	defer func() { MakefileConditional = true }()
+
+	if s := makefile(c); !strings.Contains(s, "prefix = /usr/local\n") || !strings.Contains(s, "bindir = $(execprefix)/bin\n") {
+		t.Errorf("Expected plain assignments in makefile:\n%s", s)
+	}
+
+	if out := runMake(t, c, "", "--eval=print: ; @echo '$(bindir)'", "print"); out != "/usr/local/bin\n" {
+		t.Errorf("Expected bindir /usr/local/bin, but got %s", out)
+	}
+}
+
+func TestMakefileNewline(t *testing.T) {
+	_, err := configure(t, nil, "--prefix=/opt\nfoo")
+
+	if err == nil || !strings.Contains(err.Error(), "--prefix") {
+		t.Errorf("Expected error for newline in prefix, but got %v", err)
+	}
+}
+
+func TestValidateGoConfig(t *testing.T) {
+	GoConfigBuildInfo = true
+	GoConfigExpand = false
+
+	defer func() {
+		GoConfigBuildInfo = false
+		GoConfigExpand = true
+	}()
+
+	c := parseConfig(t, nil)
+
+	if err := c.ValidateGoConfig(); err != nil {
+		t.Errorf("Unexpected error validating go config: %s", err)
+	}
+
+	Package = "bad-package"
+	defer func() { Package = "main" }()
+
+	if err := c.ValidateGoConfig(); err == nil {
+		t.Errorf("Expected error validating go config with invalid package name")
+	}
+
+	GoConfigVariable = "Var"
+	defer func() { GoConfigVariable = "AppConfig" }()
+	Package = "main"
+
+	if err := c.ValidateGoConfig(); err != nil {
+		t.Errorf("Unexpected error validating go config: %s", err)
+	}
+
+	GoConfigVariable = "type"
+
+	if err := c.ValidateGoConfig(); err == nil {
+		t.Errorf("Expected error validating go config with keyword variable name")
+	}
+
+	Strict = true
+	defer func() { Strict = false }()
+
+	if _, err := configure(t, nil); err == nil {
+		t.Errorf("Expected error configuring invalid go config in strict mode")
+	}
+}
+
+func TestGoConfigString(t *testing.T) {
+	c := parseConfig(t, nil)
+	s := c.GoConfigString()
+
+	b, err := format.Source([]byte(goConfig(c)))
+
+	if err != nil {
+		t.Fatalf("Unexpected error formatting go config: %s", err)
+	}
+
+	if s != string(b) {
+		t.Errorf("Expected formatted go config:\n%s", s)
+	}
+
+	Package = "bad-package"
+	defer func() { Package = "main" }()
+
+	if s := c.GoConfigString(); s != goConfig(c) {
+		t.Errorf("Expected unformatted go config for invalid go config:\n%s", s)
+	}
+}
+
+func TestMakefileDistcheck(t *testing.T) {
+	Target = "example"
+	defer func() { Target = "" }()
+
+	c := parseConfig(t, nil)
+	s := makefile(c)
+
+	expected := []string{
+		"check: test ## Run the tests\n",
+		"distcheck: dist ## ",
+		"trap 'rm -rf \"$$tmp\"' EXIT",
+		".PHONY: install uninstall distclean clean dist docs test check distcheck run help",
+	}
+
+	for _, e := range expected {
+		if !strings.Contains(s, e) {
+			t.Errorf("Expected makefile to contain %q:\n%s", e, s)
+		}
+	}
+
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not available")
+	}
+
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"go.mod":       "module example\n\ngo 1.16\n",
+		"main.go":      "package main\n\nfunc main() {}\n",
+		"main_test.go": "package main\n\nimport \"testing\"\n\nfunc TestExample(t *testing.T) {}\n",
+	}
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runMake(t, c, dir, "distcheck")
+}
+
+func TestSource(t *testing.T) {
+	DefaultsFile = filepath.Join(t.TempDir(), "config.site")
+	defer func() { DefaultsFile = "" }()
+
+	if err := os.WriteFile(DefaultsFile, []byte("prefix = /opt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := configure(t, nil, "--bindir=/bin")
+
+	if err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	expected := map[string]string{
+		"bindir": SourceFlag,
+		"prefix": SourceDefaultsFile,
+		"libdir": SourceDefault,
+	}
+
+	for name, source := range expected {
+		if v := c.Source(name); v != source {
+			t.Errorf("Expected source of %s to be %s, but got %s", name, source, v)
+		}
+	}
+
+	GoConfigSources = true
+	defer func() { GoConfigSources = false }()
+
+	s := goConfig(c)
+
+	for _, comment := range []string{"\t// from --bindir flag\n\tBindir string\n", "\t// default\n\tLibdir string\n", "\t// from " + DefaultsFile + "\n\tPrefix string\n"} {
+		if !strings.Contains(s, comment) {
+			t.Errorf("Expected go config to contain %q:\n%s", comment, s)
+		}
+	}
+}
+
+func TestMakefileRecursiveSources(t *testing.T) {
+	c := parseConfig(t, nil)
+
+	if s := makefile(c); !strings.Contains(s, "\nSOURCES += $(patsubst ./%,%,$(shell find . -name '*.go'))\n") {
+		t.Errorf("Expected sources to include go files in subdirectories:\n%s", s)
+	}
+
+	dir := t.TempDir()
+
+	for _, name := range []string{"main.go", filepath.Join("sub", "sub.go")} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, name), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out := runMake(t, c, dir, "--eval=print: ; @echo $(SOURCES_UNIQUE)", "print"); out != "main.go sub/sub.go\n" {
+		t.Errorf("Expected sources main.go sub/sub.go, but got %s", out)
+	}
+}
+
+func TestMakefileBuildSources(t *testing.T) {
+	c := parseConfig(t, nil)
+
+	if s := makefile(c); !strings.Contains(s, "\nBUILD_SOURCES = $(filter-out %_test.go,$(SOURCES_UNIQUE))\n") || !strings.Contains(s, "$(TARGET): $(BUILD_SOURCES) ") {
+		t.Errorf("Expected test files to be excluded from the build prerequisites:\n%s", s)
+	}
+
+	dir := t.TempDir()
+
+	for _, name := range []string{"main.go", "main_test.go", "appconfig.go"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out := runMake(t, c, dir, "--eval=print: ; @echo $(BUILD_SOURCES)", "print"); out != "appconfig.go main.go\n" {
+		t.Errorf("Expected build sources appconfig.go main.go, but got %s", out)
+	}
+}
+
+func TestMakefileExtraRules(t *testing.T) {
+	ExtraRules = "proto: ## Generate protobufs\n\t@echo generating protobufs\n"
+	ExtraPhony = []string{"proto"}
+
+	defer func() {
+		ExtraRules = ""
+		ExtraPhony = nil
+	}()
+
+	c := parseConfig(t, nil)
+	s := makefile(c)
+
+	if !strings.HasSuffix(s, "\n\nproto: ## Generate protobufs\n\t@echo generating protobufs\n\n.PHONY: install uninstall distclean clean dist docs test check distcheck run help proto") {
+		t.Errorf("Expected extra rules before the phony targets:\n%s", s)
+	}
+
+	if out := runMake(t, c, "", "proto"); out != "generating protobufs\n" {
+		t.Errorf("Expected custom rule to run, but got %s", out)
+	}
+}
+
+func TestTargetName(t *testing.T) {
+	t.Setenv("CONFIGURE_TARGET", "")
+
+	wd, err := os.Getwd()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := parseConfig(t, nil)
+
+	if v := c.TargetName(); v != filepath.Base(wd) {
+		t.Errorf("Expected target to be deduced as %s, but got %s", filepath.Base(wd), v)
+	}
+
+	Target = "example"
+	defer func() { Target = "" }()
+
+	if v := c.TargetName(); v != filepath.Base(wd) {
+		t.Errorf("Expected deduced target to be remembered, but got %s", v)
+	}
+
+	if s := makefile(c); !strings.Contains(s, "TARGET ?= "+filepath.Base(wd)+"\n") {
+		t.Errorf("Expected makefile to use the deduced target:\n%s", s)
+	}
+}
+
+func deduceTarget(c *Config) string {
+	return c.TargetName()
+}
+
+func TestTargetNameWrapper(t *testing.T) {
+	t.Setenv("CONFIGURE_TARGET", "")
+
+	wd, err := os.Getwd()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := deduceTarget(parseConfig(t, nil)); v != filepath.Base(wd) {
+		t.Errorf("Expected target to be deduced through helper as %s, but got %s", filepath.Base(wd), v)
+	}
+
+	files := []string{
+		"/go/src/configure/configure.go",
+		"/go/src/configure/configure.go",
+		"/go/src/configure/helpers.go",
+		"/home/user/wrapper/wrapper.go",
+		"/home/user/app/main.go",
+	}
+
+	if v := callerTarget("/go/src/configure", files); v != "wrapper" {
+		t.Errorf("Expected first frame outside of the package to be used, but got %s", v)
+	}
+
+	if v := callerTarget("/go/src/configure", files[:3]); v != "" {
+		t.Errorf("Expected no target without frames outside of the package, but got %s", v)
+	}
+}
+
+func TestBuildPackage(t *testing.T) {
+	if s := makefile(parseConfig(t, nil)); !strings.Contains(s, "\tgo build -o $@\n") {
+		t.Errorf("Expected no package to be built by default:\n%s", s)
+	}
+
+	BuildPackage = "./cmd/app"
+	defer func() { BuildPackage = "" }()
+
+	if s := makefile(parseConfig(t, nil)); !strings.Contains(s, "\tgo build -o $@ ./cmd/app\n") {
+		t.Errorf("Expected build package to be appended:\n%s", s)
+	}
+}
+
+func TestMakefileRun(t *testing.T) {
+	Target = "example"
+	defer func() { Target = "" }()
+
+	c := parseConfig(t, nil)
+
+	if s := makefile(c); !strings.Contains(s, "run: $(TARGET) ## ") || !strings.Contains(s, "\t./$(TARGET) $(ARGS)\n") {
+		t.Errorf("Expected run rule passing ARGS:\n%s", s)
+	}
+
+	dir := t.TempDir()
+
+	// Pretend the target has been built already
+	if err := os.WriteFile(filepath.Join(dir, "example"), []byte("#!/bin/sh\necho \"$@\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if out := runMake(t, c, dir, "run", "ARGS=-v hello"); out != "-v hello\n" {
+		t.Errorf("Expected target to run with ARGS, but got %s", out)
+	}
+}
+
+func TestRaw(t *testing.T) {
+	c := parseConfig(t, nil, "--prefix=/opt")
+
+	if v, ok := c.Raw("bindir"); !ok || v != "${execprefix}/bin" {
+		t.Errorf("Expected raw bindir ${execprefix}/bin, but got %v", v)
+	}
+
+	if v := c.Expand("bindir"); v != "/opt/bin" {
+		t.Errorf("Expected expanded bindir /opt/bin, but got %s", v)
+	}
+
+	if _, ok := c.Raw("unknown"); ok {
+		t.Errorf("Expected unknown option not to exist")
+	}
+
+	opts := &sliceOptions{Options: *NewOptions()}
+	c = parseConfig(t, opts, "--paths=${libdir}/a")
+
+	v, ok := c.Raw("paths")
+
+	if !ok {
+		t.Fatalf("Expected paths option to exist")
+	}
+
+	paths := v.([]string)
+
+	if len(paths) != 1 || paths[0] != "${libdir}/a" {
+		t.Fatalf("Expected raw paths [${libdir}/a], but got %v", paths)
+	}
+
+	paths[0] = "modified"
+
+	if opts.Paths[0] != "${libdir}/a" {
+		t.Errorf("Expected raw value to be a copy")
+	}
+}
+
+func TestDuplicateOptions(t *testing.T) {
+	defer func() { registered = nil }()
+
+	RegisterOptions("Other Directories", &struct {
+		BinDir string `long:"bindir" description:"other executables"`
+	}{})
+
+	_, err := configure(t, nil)
+
+	if err == nil || !strings.Contains(err.Error(), "bindir") || !strings.Contains(err.Error(), "Other Directories") {
+		t.Errorf("Expected error for duplicate bindir option, but got %v", err)
+	}
+}
+
+func TestGoConfigSuffix(t *testing.T) {
+	OutputDir = t.TempDir()
+	GoConfig = "config/app_gen"
+	GoConfigSuffix = ""
+
+	defer func() {
+		OutputDir = "."
+		GoConfig = "appconfig"
+		GoConfigSuffix = ".go"
+	}()
+
+	if _, err := configure(t, nil); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(OutputDir, "config", "app_gen")); err != nil {
+		t.Errorf("Expected go config to be written without suffix: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(OutputDir, "config", "app_gen.go")); !os.IsNotExist(err) {
+		t.Errorf("Expected no .go suffix to be added")
+	}
+}
+
+type nestedOptions struct {
+	A string `long:"a" description:"a"`
+	B string `long:"b" description:"b"`
+	C string `long:"c" description:"c"`
+	D string `long:"d" description:"d"`
+}
+
+func TestNestedReferences(t *testing.T) {
+	c := parseConfig(t, &nestedOptions{
+		A: "${b}/x",
+		B: "${c}/y",
+		C: "${d}/z",
+		D: "/root",
+	})
+
+	expected := map[string]string{
+		"a": "/root/z/y/x",
+		"b": "/root/z/y",
+		"c": "/root/z",
+		"d": "/root",
+	}
+
+	for name, value := range expected {
+		if v := c.Expand(name); v != value {
+			t.Errorf("Expected %s to be %s, but got %s", name, value, v)
+		}
+	}
+
+	if s := goConfig(c); !strings.Contains(s, "\t\"/root/z/y/x\",\n") {
+		t.Errorf("Expected fully expanded a in go config:\n%s", s)
+	}
+
+	if deps := c.Dependencies("a"); strings.Join(deps, " ") != "b c d" {
+		t.Errorf("Expected a to depend on b c d, but got %v", deps)
+	}
+
+	vars := "# d\nd ?= /root\n" +
+		"# c\nc ?= $(d)/z\n" +
+		"# b\nb ?= $(c)/y\n" +
+		"# a\na ?= $(b)/x\n"
+
+	s := makefile(c)
+
+	if !strings.Contains(s, vars) {
+		t.Errorf("Expected variables to be written after their dependencies:\n%s", s)
+	}
+
+	if out := runMake(t, c, "", "--eval=print: ; @echo $(a)", "print"); out != "/root/z/y/x\n" {
+		t.Errorf("Expected make to expand a to /root/z/y/x, but got %s", out)
+	}
+}
+
+func TestInstallationDirectoriesGroup(t *testing.T) {
+	c, err := configure(t, nil)
+
+	if err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	var group *flags.Group
+
+	for _, g := range c.Parser.Command.Group.Groups() {
+		if g.ShortDescription == "Installation directories" {
+			group = g
+		}
+	}
+
+	if group == nil {
+		t.Fatalf("Expected an Installation directories group")
+	}
+
+	if opt := group.FindOptionByLongName("prefix"); opt == nil {
+		t.Errorf("Expected prefix option in the Installation directories group")
+	}
+
+	if len(c.Parser.Command.Group.Options()) != 0 {
+		t.Errorf("Expected no ungrouped options")
+	}
+
+	if v := c.Expand("bindir"); v != "/usr/local/bin" {
+		t.Errorf("Expected bindir /usr/local/bin, but got %s", v)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	OutputDir = t.TempDir()
+	defer func() { OutputDir = "." }()
+
+	stderr := os.Stderr
+
+	defer func() {
+		os.Stderr = stderr
+		Quiet = false
+	}()
+
+	for _, quiet := range []bool{false, true} {
+		Quiet = quiet
+
+		r, w, err := os.Pipe()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Stderr = w
+
+		_, err = configure(t, &sliceOptions{Options: *NewOptions()}, "--ports=http")
+
+		os.Stderr = stderr
+		w.Close()
+
+		out, _ := io.ReadAll(r)
+
+		if err == nil {
+			t.Errorf("Expected error for invalid port")
+		}
+
+		if quiet && len(out) != 0 {
+			t.Errorf("Expected nothing to be printed in quiet mode, but got %q", out)
+		} else if !quiet && len(out) == 0 {
+			t.Errorf("Expected error to be printed")
+		}
+	}
+}
+
+func TestVersionFlag(t *testing.T) {
+	OutputDir = t.TempDir()
+	defer func() { OutputDir = "." }()
+
+	r, w, err := os.Pipe()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	_, err = configure(t, nil, "--version")
+
+	os.Stdout = stdout
+	w.Close()
+
+	out, _ := io.ReadAll(r)
+
+	if string(out) != "0.1\n" {
+		t.Errorf("Expected version 0.1 to be printed, but got %q", out)
+	}
+
+	if e, ok := err.(*flags.Error); !ok || e.Type != flags.ErrHelp {
+		t.Errorf("Expected help error for --version, but got %v", err)
+	}
+
+	if entries, _ := os.ReadDir(OutputDir); len(entries) != 0 {
+		t.Errorf("Expected no files to be written for --version")
+	}
+}
+
+func TestGoConfigStdout(t *testing.T) {
+	OutputDir = t.TempDir()
+	GoConfig = Stdout
+	Makefile = ""
+
+	defer func() {
+		OutputDir = "."
+		GoConfig = "appconfig"
+		Makefile = "go.make"
+	}()
+
+	r, w, err := os.Pipe()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	c, err := configure(t, nil)
+
+	os.Stdout = stdout
+	w.Close()
+
+	out, _ := io.ReadAll(r)
+
+	if err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if string(out) != c.GoConfigString() {
+		t.Errorf("Expected go config to be written to stdout, but got:\n%s", out)
+	}
+
+	if entries, _ := os.ReadDir(OutputDir); len(entries) != 0 {
+		t.Errorf("Expected no files to be written, but got %v", entries)
+	}
+}
+
+func TestVersionFlagUserDefined(t *testing.T) {
+	defer func() { registered = nil }()
+
+	opts := &struct {
+		Version string `long:"version" description:"version to build"`
+	}{}
+
+	RegisterOptions("Build", opts)
+
+	if _, err := configure(t, nil, "--version=2.0"); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if opts.Version != "2.0" {
+		t.Errorf("Expected user defined --version to be set, but got %s", opts.Version)
+	}
+}
+
+func TestGoConfigReservedField(t *testing.T) {
+	opts := &struct {
+		Options
+
+		Version       string `long:"version" description:"version to build"`
+		VersionString string `long:"version-string" description:"version string"`
+	}{Options: *NewOptions()}
+
+	c := parseConfig(t, opts, "--version=2.0")
+	s := goConfig(c)
+
+	if !strings.Contains(s, "\tVersionOption string\n") || !strings.Contains(s, "\tVersionStringOption string\n") {
+		t.Errorf("Expected conflicting options to be renamed in go config:\n%s", s)
+	}
+
+	if !strings.Contains(s, "\tVersion []int\n") || !strings.Contains(s, "\tVersionString string\n") {
+		t.Errorf("Expected generated version fields in go config:\n%s", s)
+	}
+
+	if err := c.ValidateGoConfig(); err != nil {
+		t.Errorf("Unexpected error validating go config: %s", err)
+	}
+
+	GoConfigExpand = false
+	defer func() { GoConfigExpand = true }()
+
+	if s := goConfig(c); !strings.Contains(s, "\"version\": AppConfig.VersionOption,") {
+		t.Errorf("Expected renamed field in runtime variables:\n%s", s)
+	}
+
+	if err := c.ValidateGoConfig(); err != nil {
+		t.Errorf("Unexpected error validating go config: %s", err)
+	}
+}
+
+func TestGoConfigGeneratedComment(t *testing.T) {
+	c := parseConfig(t, nil)
+
+	if s := c.GoConfigString(); !strings.HasPrefix(s, "// Code generated by go-configure; DO NOT EDIT.\n\npackage main\n") {
+		t.Errorf("Expected go config to start with generated code comment:\n%s", s)
+	}
+
+	GoConfigFragment = true
+	defer func() { GoConfigFragment = false }()
+
+	if s := goConfig(c); strings.Contains(s, "DO NOT EDIT") {
+		t.Errorf("Expected no generated code comment in fragment:\n%s", s)
+	}
+}
+
+func TestMakefileSections(t *testing.T) {
+	opts := &pluginOptions{PluginDir: "${libdir}/plugins"}
+	RegisterOptions("Plugins", opts)
+	defer func() { registered = nil }()
+
+	OutputDir = t.TempDir()
+	defer func() { OutputDir = "." }()
+
+	c, err := configure(t, nil, "--mandir=${plugindir}/man")
+
+	if err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	s := makefile(c)
+
+	dirs := strings.Index(s, "# Installation directories\n")
+	options := strings.Index(s, "# Package options\n")
+
+	if dirs < 0 || options < dirs {
+		t.Fatalf("Expected installation directories and package options sections:\n%s", s)
+	}
+
+	if i := strings.Index(s, "\nbindir ?= "); i < dirs || i > options {
+		t.Errorf("Expected bindir in the installation directories section:\n%s", s)
+	}
+
+	if i := strings.Index(s, "\nplugindir ?= $(libdir)/plugins\n"); i < options {
+		t.Errorf("Expected plugindir in the package options section:\n%s", s)
+	}
+
+	// Directories depending on package options are written after them
+	if i := strings.Index(s, "\nmandir ?= $(plugindir)/man\n"); i < strings.Index(s, "\nplugindir ?= ") {
+		t.Errorf("Expected mandir to be written after plugindir:\n%s", s)
+	}
+}
+
+func TestExpandInvalidReferences(t *testing.T) {
+	c := parseConfig(t, nil, "--prefix=/opt", "--bindir=${}/bin", "--libdir=${1x}${prefix}/lib", "--mandir=${with space}")
+
+	expected := map[string]string{
+		"bindir": "${}/bin",
+		"libdir": "${1x}/opt/lib",
+		"mandir": "${with space}",
+	}
+
+	for name, value := range expected {
+		if v := c.Expand(name); v != value {
+			t.Errorf("Expected %s to be %s, but got %s", name, value, v)
+		}
+	}
+
+	if deps := c.Dependencies("libdir"); strings.Join(deps, " ") != "prefix" {
+		t.Errorf("Expected libdir to only depend on prefix, but got %v", deps)
+	}
+}
+
+func TestExpandEscapedReferences(t *testing.T) {
+	c := parseConfig(t, nil, "--prefix=/opt", "--bindir=$${prefix}/bin", "--libdir=${}/${with space}/${prefix}/lib")
+
+	if v := c.Expand("bindir"); v != "$${prefix}/bin" {
+		t.Errorf("Expected bindir to be $${prefix}/bin, but got %s", v)
+	}
+
+	if deps := c.Dependencies("bindir"); len(deps) != 0 {
+		t.Errorf("Expected bindir to have no dependencies, but got %v", deps)
+	}
+
+	if v := c.Expand("libdir"); v != "${}/${with space}//opt/lib" {
+		t.Errorf("Expected invalid references in libdir to be kept, but got %s", v)
+	}
+
+	Target = "example"
+	defer func() { Target = "" }()
+
+	// The go config, make and the runtime expand function agree on escaped
+	// and invalid references
+	expected := c.Expand("bindir") + " " + c.Expand("libdir")
+
+	if out := runMake(t, c, "", "--eval=print: ; @echo '$(bindir) $(libdir)'", "print"); out != expected+"\n" {
+		t.Errorf("Expected %s in make, but got %s", expected, out)
+	}
+
+	GoConfigExpand = false
+	defer func() { GoConfigExpand = true }()
+
+	out := runGoConfig(t, c, "package main\n\nfunc main() {\n\tprint(AppConfigExpand(AppConfig.Bindir), \" \", AppConfigExpand(AppConfig.Libdir))\n}\n")
+
+	if out != expected {
+		t.Errorf("Expected %s at runtime, but got %s", expected, out)
+	}
+}
+
+func BenchmarkExpand(b *testing.B) {
+	c, err := parseArgs(nil, "--prefix=/opt")
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c.expanded = c.expand()
+	}
+}
+
+func TestParseGitVersion(t *testing.T) {
+	tests := map[string]string{
+		"v1.2.3":           "[1 2 3]",
+		"1.2.3-4-g1234abc": "[1 2 3]",
+		"v2.0":             "[2 0]",
+		"v3-rc1":           "[3]",
+		"v1.2.3+build.5":   "[1 2 3]",
+		"release-1.2.3":    "",
+		"v1.2.3.4":         "",
+		"v1.2x":            "",
+		"g1234abc":         "",
+	}
+
+	for s, expected := range tests {
+		v, err := parseGitVersion(s)
+
+		if len(expected) == 0 {
+			if err == nil {
+				t.Errorf("Expected error parsing %s, but got %v", s, v)
+			}
+		} else if err != nil {
+			t.Errorf("Unexpected error parsing %s: %s", s, err)
+		} else if fmt.Sprintf("%v", v) != expected {
+			t.Errorf("Expected %s to parse as %s, but got %v", s, expected, v)
+		}
+	}
+}
+
+func TestMakefileDist(t *testing.T) {
+	Target = "example"
+	defer func() { Target = "" }()
+
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not available")
+	}
+
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"go.mod":          "module example\n\ngo 1.16\n",
+		"main.go":         "package main\n\nimport _ \"embed\"\n\n//go:embed assets/data.txt\nvar data string\n\nfunc main() {}\n",
+		"assets/data.txt": "data\n",
+	}
+
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runMake(t, parseConfig(t, nil), dir, "dist")
+
+	out, err := exec.Command("tar", "-tzf", filepath.Join(dir, "example-0.1.tar.gz")).Output()
+
+	if err != nil {
+		t.Fatalf("Unexpected error listing tarball: %s", err)
+	}
+
+	contents := strings.Fields(string(out))
+	sort.Strings(contents)
+
+	if strings.Join(contents, " ") != "example-0.1/ example-0.1/assets/ example-0.1/assets/data.txt example-0.1/go.make example-0.1/go.mod example-0.1/main.go" {
+		t.Errorf("Unexpected tarball contents: %v", contents)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "example-0.1")); !os.IsNotExist(err) {
+		t.Errorf("Expected dist directory to be removed")
+	}
+}
+
+func TestGoConfigTest(t *testing.T) {
+	gobin, err := exec.LookPath("go")
+
+	if err != nil {
+		t.Skip("go tool not available")
+	}
+
+	GoConfigTest = true
+	OutputDir = t.TempDir()
+
+	defer func() {
+		GoConfigTest = false
+		OutputDir = "."
+	}()
+
+	if _, err := configure(t, nil); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(OutputDir, "appconfig_test.go")); err != nil {
+		t.Fatalf("Expected appconfig_test.go to be written: %s", err)
+	}
+
+	main := "package main\n\nimport \"testing\"\n\nfunc TestConfig(t *testing.T) {\n\tif AppConfig.Bindir != \"/usr/local/bin\" {\n\t\tt.Fail()\n\t}\n}\n"
+
+	if err := os.WriteFile(filepath.Join(OutputDir, "main_test.go"), []byte(main), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(gobin, "test", ".")
+	cmd.Dir = OutputDir
+	cmd.Env = append(os.Environ(), "GOFLAGS=", "GO111MODULE=off")
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Unexpected error testing go config: %s\n%s", err, out)
+	}
+}
+
+func TestMakefileUninstall(t *testing.T) {
+	Target = "example"
+	defer func() { Target = "" }()
+
+	dir := t.TempDir()
+	destdir := filepath.Join(dir, "dest")
+
+	// Pretend the target has been built already
+	if err := os.WriteFile(filepath.Join(dir, "example"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := parseConfig(t, nil)
+	runMake(t, c, dir, "install", "DESTDIR="+destdir)
+
+	bindir := filepath.Join(destdir, "usr", "local", "bin")
+
+	if _, err := os.Stat(filepath.Join(bindir, "example")); err != nil {
+		t.Fatalf("Expected target to be installed: %s", err)
+	}
+
+	runMake(t, c, dir, "uninstall", "DESTDIR="+destdir)
+
+	if _, err := os.Stat(bindir); !os.IsNotExist(err) {
+		t.Errorf("Expected empty install directory to be removed")
+	}
+
+	// Non-empty directories are kept
+	runMake(t, c, dir, "install", "DESTDIR="+destdir)
+	os.WriteFile(filepath.Join(bindir, "other"), []byte{}, 0755)
+	runMake(t, c, dir, "uninstall", "DESTDIR="+destdir)
+
+	if _, err := os.Stat(filepath.Join(bindir, "other")); err != nil {
+		t.Errorf("Expected non-empty install directory to be kept")
+	}
+}
+
+func TestRelPath(t *testing.T) {
+	c := parseConfig(t, nil)
+
+	if p, err := c.RelPath("bindir", "libdir"); err != nil || p != "../lib" {
+		t.Errorf("Expected relative path ../lib from bindir to libdir, but got %s (%v)", p, err)
+	}
+
+	if p, err := c.RelPath("bindir", "mandir"); err != nil || p != "../share/man" {
+		t.Errorf("Expected relative path ../share/man from bindir to mandir, but got %s (%v)", p, err)
+	}
+
+	if _, err := c.RelPath("bindir", "nonexisting"); err == nil {
+		t.Errorf("Expected error for unknown directory option")
+	}
+}
+
+func TestExpandDeterministic(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		c := parseConfig(t, nil, "--execprefix=/opt/exec", "--datadir=${mandir}/data", "--mandir=${datadir}/man")
+
+		if v := c.Expand("bindir"); v != "/opt/exec/bin" {
+			t.Fatalf("Expected bindir to be /opt/exec/bin, but got %s", v)
+		}
+
+		if v := c.Expand("libexecdir"); v != "/opt/exec/libexec" {
+			t.Fatalf("Expected libexecdir to be /opt/exec/libexec, but got %s", v)
+		}
+
+		// Circular references resolve the same way on every run
+		if v := c.Expand("datadir"); v != "/man/data" {
+			t.Fatalf("Expected datadir to be /man/data, but got %s", v)
+		}
+
+		if v := c.Expand("mandir"); v != "/man" {
+			t.Fatalf("Expected mandir to be /man, but got %s", v)
+		}
+	}
+}
+
+func TestMakefilePrologueEpilogue(t *testing.T) {
+	MakefilePrologue = "# Banner"
+	MakefileEpilogue = "-include local.mk\n"
+
+	defer func() {
+		MakefilePrologue = ""
+		MakefileEpilogue = ""
+	}()
+
+	s := makefile(parseConfig(t, nil))
+
+	if !strings.HasPrefix(s, "#!/usr/bin/make -f\n\n# Banner\n\n# Installation directories\n") {
+		t.Errorf("Expected prologue after the shebang:\n%s", s)
+	}
+
+	if !strings.HasSuffix(s, "\n\n-include local.mk\n") {
+		t.Errorf("Expected epilogue at the end:\n%s", s)
+	}
+}
+
+func TestStrictArguments(t *testing.T) {
+	if _, err := configure(t, nil, "prefix=/usr"); err != nil {
+		t.Errorf("Unexpected error for positional argument in non-strict mode: %s", err)
+	}
+
+	Strict = true
+	defer func() { Strict = false }()
+
+	_, err := configure(t, nil, "--unknown", "prefix=/usr", "--bindir=/bin")
+
+	if err == nil {
+		t.Fatalf("Expected error for positional argument in strict mode")
+	}
+
+	if err.Error() != "unexpected arguments: prefix=/usr" {
+		t.Errorf("Unexpected error message: %s", err)
+	}
+}
+
+func TestMakefileDeterministic(t *testing.T) {
+	c := parseConfig(t, nil)
+	expected := makefile(c)
+
+	for i := 0; i < 20; i++ {
+		if s := makefile(parseConfig(t, nil)); s != expected {
+			t.Fatalf("Expected makefile to be identical across runs:\n%s\n\n%s", expected, s)
+		}
+	}
+
+	vars := "# Installation directories\n" +
+		"# install architecture-independent files in PREFIX\nprefix ?= /usr/local\n" +
+		"# read-only arch.-independent data root\ndatarootdir ?= $(prefix)/share\n" +
+		"# read-only arc.-independent data\ndatadir ?= $(datarootdir)\n" +
+		"# install architecture-dependent files in EPREFIX\nexecprefix ?= $(prefix)\n" +
+		"# user executables\nbindir ?= $(execprefix)/bin\n" +
+		"# program executables\nlibdir ?= $(execprefix)/lib\n" +
+		"# program executables\nlibexecdir ?= $(execprefix)/libexec\n" +
+		"# man documentation\nmandir ?= $(datarootdir)/man\n" +
+		"# read-only single-machine data\nsysconfdir ?= $(prefix)/etc\n\n" +
+		"# Package options\n" +
+		"buildid ?= " + c.buildID + "\n" +
+		"goconfig ?= appconfig.go\n" +
+		"makefile ?= go.make\n"
+
+	if !strings.Contains(expected, vars) {
+		t.Errorf("Expected variables in dependency and alphabetical order:\n%s", expected)
+	}
+}
+
+func TestGoConfigFragment(t *testing.T) {
+	c := parseConfig(t, nil)
+
+	if s := goConfig(c); !strings.HasPrefix(s, "// Code generated by go-configure; DO NOT EDIT.\n\npackage main\n\nvar AppConfig = struct {\n") {
+		t.Errorf("Expected complete go config by default:\n%s", s)
+	}
+
+	GoConfigFragment = true
+	defer func() { GoConfigFragment = false }()
+
+	s := goConfig(c)
+
+	if !strings.HasPrefix(s, "\t// --bindir: user executables\n\tBindir string\n") {
+		t.Errorf("Expected go config fragment to start with the first field:\n%s", s)
+	}
+
+	if strings.Contains(s, "package") || strings.Contains(s, "AppConfig") || strings.Contains(s, "/usr/local") {
+		t.Errorf("Expected go config fragment to only contain fields:\n%s", s)
+	}
+
+	src := "package main\n\ntype Config struct {\n" + s + "}\n"
+
+	if _, err := format.Source([]byte(src)); err != nil {
+		t.Errorf("Expected go config fragment to be embeddable in a struct: %s\n%s", err, src)
+	}
+}
+
+func TestWriteRPMSpec(t *testing.T) {
+	Target = "example"
+	Version = []int{1, 2, 0}
+	VersionSuffix = "-rc1"
+
+	defer func() {
+		Target = ""
+		Version = []int{0, 1}
+		VersionSuffix = ""
+	}()
+
+	var buf bytes.Buffer
+
+	parseConfig(t, nil).WriteRPMSpec(&buf)
+	s := buf.String()
+
+	expected := []string{
+		"Name:           example\n",
+		"Version:        1.2.0~rc1\n",
+		" bindir=%{_bindir} ",
+		"%files\n%{_bindir}/example\n",
+		"#%{_mandir}/man1/example.1*\n",
+	}
+
+	for _, e := range expected {
+		if !strings.Contains(s, e) {
+			t.Errorf("Expected spec file to contain %q:\n%s", e, s)
+		}
+	}
+}
+
+func TestEnabledOutputs(t *testing.T) {
+	if v := strings.Join(EnabledOutputs(), " "); v != "goconfig makefile wrapper" {
+		t.Errorf("Expected default outputs goconfig makefile wrapper, but got %s", v)
+	}
+
+	GoConfig = ""
+	NinjaFile = "build.ninja"
+	RPMSpec = "example.spec"
+
+	defer func() {
+		GoConfig = "appconfig"
+		NinjaFile = ""
+		RPMSpec = ""
+	}()
+
+	if v := strings.Join(EnabledOutputs(), " "); v != "makefile wrapper ninja rpmspec" {
+		t.Errorf("Expected outputs makefile wrapper ninja rpmspec, but got %s", v)
+	}
+
+	WrapperOnly = true
+	defer func() { WrapperOnly = false }()
+
+	if v := strings.Join(EnabledOutputs(), " "); v != "wrapper" {
+		t.Errorf("Expected only the wrapper output, but got %s", v)
+	}
+}
+
+func TestFeature(t *testing.T) {
+	defer func() { features = nil }()
+
+	docs := Feature("docs", "build the documentation", false)
+	ssl := Feature("ssl", "use ssl", true)
+
+	c, err := configure(t, nil, "--enable-docs", "--disable-ssl")
+
+	if err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if !*docs {
+		t.Errorf("Expected docs feature to be enabled")
+	}
+
+	if *ssl {
+		t.Errorf("Expected ssl feature to be disabled")
+	}
+
+	s := goConfig(c)
+
+	if !strings.Contains(s, "\t// --enable-docs: build the documentation\n\tEnableDocs bool\n") || !strings.Contains(s, "\ttrue,\n\tfalse,\n") {
+		t.Errorf("Expected resolved features in go config:\n%s", s)
+	}
+
+	if strings.Contains(s, "DisableDocs") {
+		t.Errorf("Expected no disable options in go config:\n%s", s)
+	}
+
+	if s := makefile(c); !strings.Contains(s, "# build the documentation\nenable-docs ?= 1\n# use ssl\nenable-ssl ?=\n") {
+		t.Errorf("Expected resolved features in makefile:\n%s", s)
+	}
+
+	if _, err := configure(t, nil); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if !*ssl {
+		t.Errorf("Expected ssl feature to be enabled by default")
+	}
+}
+
+type boolOptions struct {
+	Options
+
+	Debug   bool   `long:"debug" description:"enable debugging"`
+	Static  bool   `long:"static" description:"link statically"`
+	Message string `long:"message" description:"message"`
+}
+
+func TestMakefileBool(t *testing.T) {
+	Target = "example"
+	defer func() { Target = "" }()
+
+	opts := &boolOptions{Options: *NewOptions()}
+	c := parseConfig(t, opts, "--debug", "--message=${prefix}")
+
+	s := makefile(c)
+
+	if !strings.Contains(s, "debug ?= 1\n") || !strings.Contains(s, "static ?=\n") {
+		t.Errorf("Expected bool options as 1 or empty in makefile:\n%s", s)
+	}
+
+	if !strings.Contains(s, "# message\nmessage ?= $(prefix)\n") {
+		t.Errorf("Expected string option reference in makefile:\n%s", s)
+	}
+
+	if out := runMake(t, c, "", "--eval=print: ; @echo '$(if $(debug),debug)-$(if $(static),static)'", "print"); out != "debug-\n" {
+		t.Errorf("Expected debug to be true and static to be false, but got %s", out)
+	}
+}
+
+func TestWithPackage(t *testing.T) {
+	defer func() { packages = nil }()
+
+	ssl := WithPackage("ssl", "use ssl from the given prefix", "no")
+
+	tests := []struct {
+		Args  []string
+		Value string
+	}{
+		{[]string{"--with-ssl=${prefix}/ssl"}, "/usr/local/ssl"},
+		{[]string{"--with-ssl"}, "yes"},
+		{[]string{"--without-ssl"}, "no"},
+		{nil, "no"},
+	}
+
+	for _, test := range tests {
+		c, err := configure(t, nil, test.Args...)
+
+		if err != nil {
+			t.Fatalf("Unexpected error configuring %v: %s", test.Args, err)
+		}
+
+		if v := c.Expand("with-ssl"); v != test.Value {
+			t.Errorf("Expected with-ssl to be %s for %v, but got %s", test.Value, test.Args, v)
+		}
+
+		if s := goConfig(c); !strings.Contains(s, "\tWithSsl string\n") || !strings.Contains(s, fmt.Sprintf("\t%#v,\n", test.Value)) {
+			t.Errorf("Expected with-ssl in go config:\n%s", s)
+		}
+	}
+
+	if *ssl != "no" {
+		t.Errorf("Expected registered value to be updated, but got %s", *ssl)
+	}
+}
+
+type extraOptions struct {
+	Options
+
+	Extra string `long:"extra" description:"extra value"`
+}
+
+func TestGoConfigOmitEmpty(t *testing.T) {
+	c := parseConfig(t, &extraOptions{Options: *NewOptions()})
+
+	if s := goConfig(c); !strings.Contains(s, "\t// --extra: extra value\n\t//\n\t// Note: resolved to an empty value\n\tExtra string\n") {
+		t.Errorf("Expected empty value to be annotated:\n%s", s)
+	}
+
+	GoConfigOmitEmpty = true
+	defer func() { GoConfigOmitEmpty = false }()
+
+	s := goConfig(c)
+
+	if strings.Contains(s, "Extra") || strings.Contains(s, "\t\"\",\n") {
+		t.Errorf("Expected empty value to be omitted:\n%s", s)
+	}
+
+	if _, err := c.formatGoConfig(Package); err != nil {
+		t.Errorf("Unexpected error formatting go config: %s", err)
+	}
+}
+
+func TestMakefileDocs(t *testing.T) {
+	Target = "example"
+	defer func() { Target = "" }()
+
+	c := parseConfig(t, nil)
+
+	if s := makefile(c); !strings.Contains(s, "docs: ## Build the documentation\n\t$(DOCGEN)\n") {
+		t.Errorf("Expected docs target to use DOCGEN:\n%s", s)
+	}
+
+	if out := runMake(t, c, "", "docs"); out != "DOCGEN is not set, no documentation generated\n" {
+		t.Errorf("Expected message without DOCGEN, but got %s", out)
+	}
+
+	dir := t.TempDir()
+
+	runMake(t, c, dir, "docs", "DOCGEN=mkdir -p html", "DOCOUTPUT=html")
+
+	if _, err := os.Stat(filepath.Join(dir, "html")); err != nil {
+		t.Fatalf("Expected documentation to be generated: %s", err)
+	}
+
+	runMake(t, c, dir, "clean", "DOCOUTPUT=html")
+
+	if _, err := os.Stat(filepath.Join(dir, "html")); !os.IsNotExist(err) {
+		t.Errorf("Expected documentation to be removed by clean")
+	}
+}
+
+func TestOptionTransform(t *testing.T) {
+	OptionTransform = func(longname, value string) string {
+		if longname == "prefix" {
+			return strings.ToUpper(value)
+		}
+
+		return value
+	}
+
+	defer func() { OptionTransform = nil }()
+
+	c := parseConfig(t, nil)
+
+	if v := c.Expand("bindir"); v != "/USR/LOCAL/bin" {
+		t.Errorf("Expected bindir to use the transformed prefix, but got %s", v)
+	}
+
+	if s := goConfig(c); !strings.Contains(s, "\t\"/USR/LOCAL\",\n") || !strings.Contains(s, "\t\"/USR/LOCAL/bin\",\n") {
+		t.Errorf("Expected transformed prefix and bindir in go config:\n%s", s)
+	}
+
+	s := makefile(c)
+
+	if !strings.Contains(s, "prefix ?= /USR/LOCAL\n") || !strings.Contains(s, "bindir ?= $(execprefix)/bin\n") {
+		t.Errorf("Expected transformed prefix in makefile:\n%s", s)
+	}
+
+	if out := runMake(t, c, "", "--eval=print: ; @echo '$(bindir)'", "print"); out != "/USR/LOCAL/bin\n" {
+		t.Errorf("Expected make bindir /USR/LOCAL/bin, but got %s", out)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	c := parseConfig(t, nil)
+
+	OutputDir = t.TempDir()
+	defer func() { OutputDir = "." }()
+
+	if err := c.GenerateGoConfig(); err != nil {
+		t.Fatalf("Unexpected error generating go config: %s", err)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(OutputDir, "*")); len(files) != 1 || filepath.Base(files[0]) != "appconfig.go" {
+		t.Errorf("Expected only appconfig.go to be generated, but got %v", files)
+	}
+
+	OutputDir = t.TempDir()
+
+	if err := c.GenerateMakefile(); err != nil {
+		t.Fatalf("Unexpected error generating makefile: %s", err)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(OutputDir, "*")); len(files) != 1 || filepath.Base(files[0]) != "go.make" {
+		t.Errorf("Expected only go.make to be generated, but got %v", files)
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := map[string]string{
+		"/usr/local/":      "/usr/local",
+		"/usr//local//bin": "/usr/local/bin",
+		"/":                "/",
+		"//host/share/":    "//host/share",
+		"///usr":           "/usr",
+		"relative//path/":  "relative//path/",
+		"${prefix}/":       "${prefix}/",
+	}
+
+	for p, expected := range tests {
+		if v := cleanPath(p); v != expected {
+			t.Errorf("Expected %s to clean to %s, but got %s", p, expected, v)
+		}
+	}
+}
+
+func TestTrailingSlashPrefix(t *testing.T) {
+	c := parseConfig(t, nil, "--prefix=/usr/local/")
+
+	if v := c.Expand("bindir"); v != "/usr/local/bin" {
+		t.Errorf("Expected bindir to be /usr/local/bin, but got %s", v)
+	}
+
+	if s := makefile(c); !strings.Contains(s, "prefix ?= /usr/local\n") {
+		t.Errorf("Expected trailing slash to be removed from prefix in makefile:\n%s", s)
+	}
+
+	if s := goConfig(c); strings.Contains(s, "//bin") {
+		t.Errorf("Expected no double slashes in go config:\n%s", s)
+	}
+
+	if v, _ := c.Raw("prefix"); v != "/usr/local/" {
+		t.Errorf("Expected raw prefix to be /usr/local/, but got %v", v)
+	}
+}
+
+func TestCleanPathDirectoriesOnly(t *testing.T) {
+	opts := &struct {
+		Options
+
+		URL string `long:"url" description:"url"`
+	}{Options: *NewOptions()}
+
+	c := parseConfig(t, opts, "--url=/api//v1/")
+
+	if v := c.Expand("url"); v != "/api//v1/" {
+		t.Errorf("Expected url to be kept as /api//v1/, but got %s", v)
+	}
+
+	if s := makefile(c); !strings.Contains(s, "url ?= /api//v1/\n") {
+		t.Errorf("Expected url to be kept in makefile:\n%s", s)
+	}
+}
+
+func TestWriteShellExports(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+
+	if err != nil {
+		t.Skip("sh not available")
+	}
+
+	var buf bytes.Buffer
+
+	parseConfig(t, nil, "--prefix=/opt/it's here").WriteShellExports(&buf)
+
+	if !strings.Contains(buf.String(), "export BINDIR='/opt/it'\\''s here/bin'\n") {
+		t.Errorf("Expected quoted BINDIR export:\n%s", buf.String())
+	}
+
+	filename := filepath.Join(t.TempDir(), "config.sh")
+
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(sh, "-c", ". \"$0\" && sh -c 'echo \"$BINDIR\" \"$VERSION\"'", filename).Output()
+
+	if err != nil {
+		t.Fatalf("Unexpected error sourcing exports: %s", err)
+	}
+
+	if string(out) != "/opt/it's here/bin 0.1\n" {
+		t.Errorf("Expected BINDIR and VERSION to be exported, but got %s", out)
+	}
+}
+
+func TestWriteShell(t *testing.T) {
+	c := parseConfig(t, nil, "--prefix=/opt/it's here")
+
+	var shell, exports bytes.Buffer
+
+	c.WriteShell(&shell)
+	c.WriteShellExports(&exports)
+
+	if !strings.Contains(shell.String(), "export BINDIR='/opt/it'\\''s here/bin'\n") {
+		t.Errorf("Expected quoted BINDIR export:\n%s", shell.String())
+	}
+
+	if shell.String() != exports.String() {
+		t.Errorf("Expected WriteShell and WriteShellExports to write the same script:\n%s\n%s", shell.String(), exports.String())
+	}
+}
+
+func TestShellFile(t *testing.T) {
+	OutputDir = t.TempDir()
+	ShellFile = "config.sh"
+
+	defer func() {
+		OutputDir = "."
+		ShellFile = ""
+	}()
+
+	if _, err := configure(t, nil, "--prefix=/opt/my app"); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(OutputDir, "config.sh"))
+
+	if err != nil {
+		t.Fatalf("Expected shell file to be written: %s", err)
+	}
+
+	if !strings.Contains(string(b), "export PREFIX='/opt/my app'\n") {
+		t.Errorf("Expected escaped PREFIX export:\n%s", b)
+	}
+}
+
+func TestGoConfigPackages(t *testing.T) {
+	OutputDir = t.TempDir()
+	GoConfigPackages = map[string]string{
+		"server/appconfig.go": "server",
+		"client/appconfig.go": "client",
+	}
+
+	defer func() {
+		OutputDir = "."
+		GoConfigPackages = nil
+	}()
+
+	if _, err := configure(t, nil, "--prefix=/opt"); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	for _, pkg := range []string{"server", "client"} {
+		b, err := os.ReadFile(filepath.Join(OutputDir, pkg, "appconfig.go"))
+
+		if err != nil {
+			t.Fatalf("Expected go config to be written for %s: %s", pkg, err)
+		}
+
+		s := string(b)
+
+		if !strings.Contains(s, "\npackage "+pkg+"\n") {
+			t.Errorf("Expected package %s clause:\n%s", pkg, s)
+		}
+
+		if !strings.Contains(s, "\"/opt/bin\",") {
+			t.Errorf("Expected resolved bindir in %s go config:\n%s", pkg, s)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(OutputDir, "appconfig.go")); err != nil {
+		t.Errorf("Expected main go config to be written: %s", err)
+	}
+}
+
+func TestGoConfigPackagesMain(t *testing.T) {
+	OutputDir = t.TempDir()
+	GoConfigPackages = map[string]string{
+		"internal/config/appconfig.go": "config",
+	}
+
+	defer func() {
+		OutputDir = "."
+		GoConfigPackages = nil
+	}()
+
+	if _, err := configure(t, nil); err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	files := map[string]string{
+		"appconfig.go":                 "\npackage main\n",
+		"internal/config/appconfig.go": "\npackage config\n",
+	}
+
+	for name, clause := range files {
+		b, err := os.ReadFile(filepath.Join(OutputDir, filepath.FromSlash(name)))
+
+		if err != nil {
+			t.Fatalf("Expected %s to be written: %s", name, err)
+		}
+
+		if !strings.Contains(string(b), clause) {
+			t.Errorf("Expected %s to contain %q:\n%s", name, clause, b)
+		}
+	}
+}
+
+type shortOptions struct {
+	Options
+
+	Jobs int `short:"j" long:"jobs" description:"number of jobs"`
+}
+
+func TestGoConfigFlagComments(t *testing.T) {
+	s := goConfig(parseConfig(t, &shortOptions{Options: *NewOptions()}))
+
+	if !strings.Contains(s, "\t// --prefix: install architecture-independent files in PREFIX\n\tPrefix string\n") {
+		t.Errorf("Expected long flag name in comment:\n%s", s)
+	}
+
+	if !strings.Contains(s, "\t// -j, --jobs: number of jobs\n\tJobs int\n") {
+		t.Errorf("Expected short and long flag names in comment:\n%s", s)
+	}
+}
+
+type undocumentedOptions struct {
+	Options
+
+	Level int `long:"level"`
+}
+
+func TestGoConfigNoDescription(t *testing.T) {
+	s := goConfig(parseConfig(t, &undocumentedOptions{Options: *NewOptions()}))
+
+	if !strings.Contains(s, "\t// --execprefix: install architecture-dependent files in EPREFIX\n\tExecprefix string\n\n\tLevel int\n\n") {
+		t.Errorf("Expected no comment for option without description:\n%s", s)
+	}
+
+	if strings.Contains(s, "--level") || strings.Contains(s, "\t//\n") {
+		t.Errorf("Expected no stray comment lines:\n%s", s)
+	}
+}
+
+type pluginOptions struct {
+	PluginDir string `long:"plugindir" description:"plugin directory"`
+}
+
+func registerPluginOptions() *pluginOptions {
+	opts := &pluginOptions{PluginDir: "${libdir}/plugins"}
+	RegisterOptions("Plugins", opts)
+
+	return opts
+}
+
+func TestRegisterOptions(t *testing.T) {
+	defer func() { registered = nil }()
+
+	opts := registerPluginOptions()
+
+	c, err := configure(t, nil, "--prefix=/opt")
+
+	if err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if opts.PluginDir != "${libdir}/plugins" {
+		t.Errorf("Expected registered options to be parsed, but got %s", opts.PluginDir)
+	}
+
+	if s := goConfig(c); !strings.Contains(s, "\tPlugindir string\n") || !strings.Contains(s, "\t\"/opt/lib/plugins\",\n") {
+		t.Errorf("Expected registered option in go config:\n%s", s)
+	}
+
+	if s := makefile(c); !strings.Contains(s, "plugindir ?= $(libdir)/plugins\n") {
+		t.Errorf("Expected registered option in makefile:\n%s", s)
+	}
+}
+
+func TestSaveDefaults(t *testing.T) {
+	DefaultsFile = filepath.Join(t.TempDir(), "config.site")
+	defer func() { DefaultsFile = "" }()
+
+	c, err := configure(t, nil, "--prefix=/opt/saved", "--save-defaults")
+
+	if err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if s := goConfig(c); strings.Contains(s, "SaveDefaults") {
+		t.Errorf("Expected builtin options not to be written to the go config:\n%s", s)
+	}
+
+	if b, _ := os.ReadFile(DefaultsFile); !strings.Contains(string(b), "bindir = ${execprefix}/bin\n") {
+		t.Errorf("Expected unexpanded values in defaults file:\n%s", b)
+	}
+
+	c, err = configure(t, nil)
+
+	if err != nil {
+		t.Fatalf("Unexpected error configuring: %s", err)
+	}
+
+	if v := c.Expand("bindir"); v != "/opt/saved/bin" {
+		t.Errorf("Expected saved prefix to be the new default, but got bindir %s", v)
+	}
+}
+
+type shortOnlyOptions struct {
+	Options
+
+	Jobs    int    `short:"j" description:"number of jobs"`
+	WorkDir string `short:"w" description:"work directory" default:"${prefix}/work"`
+}
+
+func TestShortOnlyOptions(t *testing.T) {
+	c := parseConfig(t, &shortOnlyOptions{Options: *NewOptions()}, "-j4")
+
+	s := goConfig(c)
+
+	if !strings.Contains(s, "\t// -j: number of jobs\n\tJobs int\n") || !strings.Contains(s, "\t4,\n") {
+		t.Errorf("Expected short only option in go config:\n%s", s)
+	}
+
+	if !strings.Contains(s, "\tWorkDir string\n") || !strings.Contains(s, "\t\"/usr/local/work\",\n") {
+		t.Errorf("Expected expanded short only option in go config:\n%s", s)
+	}
+
+	s = makefile(c)
+
+	if !strings.Contains(s, "Jobs ?= 4\n") || !strings.Contains(s, "WorkDir ?= $(prefix)/work\n") {
+		t.Errorf("Expected short only options in makefile:\n%s", s)
+	}
+}
+
+func TestMakefileInstallMode(t *testing.T) {
+	Target = "example"
+	defer func() { Target = "" }()
+
+	c := parseConfig(t, nil)
+
+	if s := makefile(c); !strings.Contains(s, "BINMODE ?= 0755\n") || !strings.Contains(s, "$(INSTALL_PROGRAM) $(TARGET) ") || !strings.Contains(s, "INSTALL_PROGRAM = $(INSTALL) -m $(BINMODE)\n") {
+		t.Errorf("Expected install recipe to use the BINMODE variable:\n%s", s)
+	}
+
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "example"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runMake(t, c, dir, "install", "DESTDIR="+filepath.Join(dir, "dest"), "BINMODE=0750")
+
+	info, err := os.Stat(filepath.Join(dir, "dest", "usr", "local", "bin", "example"))
+
+	if err != nil {
+		t.Fatalf("Expected target to be installed: %s", err)
+	}
+
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("Expected installed target to have mode 0750, but got %o", info.Mode().Perm())
+	}
+}
+
+func TestMakefileOrderOnlyDirectories(t *testing.T) {
+	c := parseConfig(t, nil)
+	s := makefile(c)
+
+	if !strings.Contains(s, "install: $(TARGET) | $(DESTDIR)$($(TARGET)_installdir)/ ") {
+		t.Errorf("Expected install to have an order-only prerequisite on its destination directory:\n%s", s)
+	}
+
+	if !strings.Contains(s, "%/:\n\tmkdir -p $@\n") {
+		t.Errorf("Expected a directory creation rule:\n%s", s)
+	}
+}